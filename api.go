@@ -1,42 +1,69 @@
 package manbearpig
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type JobNotificationList struct {
 	Jobs []*Notification `json:"jobs"`
-	Auth string          `json:"auth"`
+	Auth string          `json:"auth"` // optional, overrides the registered credentials
 }
 
+// QueueFullRetryAfter is the number of seconds clients are asked
+// to wait when jobs are rejected because the workers are busy.
+const QueueFullRetryAfter int = 5
+
 type APIServer struct {
 	Port           string
 	ServiceManager *ServiceManager
+	Keys           *APIKeys // clients allowed to use the api, anyone if nil
+	server         *http.Server
 }
 
 var API *APIServer
 
-func (a *APIServer) processJobs(jobs *JobNotificationList) {
-	for _, job := range jobs.Jobs {
-		log.Printf("%+v", job)
-		// Send to worker, could add db here for fault tolerance.
-		go func(jb *Notification) {
-			log.Printf("Starting %v", jb)
-			a.ServiceManager.Work(jb, jobs.Auth)
-		}(job)
+func (a *APIServer) processJobs(jobs *JobNotificationList) error {
+	// Persisted before returning so the jobs survive a restart.
+	err := a.ServiceManager.Enqueue(jobs.Jobs, jobs.Auth)
+	if err != nil {
+		return err
+	}
+	log.Printf("Finished adding %d jobs", len(jobs.Jobs))
+	return nil
+}
+
+// JobsResponse lists the ids of the accepted jobs, in the order they
+// were sent, and why the others were not accepted.
+type JobsResponse struct {
+	Jobs   []string     `json:"jobs"`
+	Errors []*JobErrors `json:"errors,omitempty"`
+	Error  string       `json:"error,omitempty"` // set when the whole request failed
+}
+
+func writeJobsResponse(w http.ResponseWriter, code int, resp *JobsResponse) {
+	if resp.Jobs == nil {
+		resp.Jobs = []string{}
 	}
-	log.Printf("Finished adding jobs")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
 }
 
+// JobsHandler accepts the valid jobs of a request. If none are valid
+// the response is 400, listing the errors of each job.
 func (a *APIServer) JobsHandler(w http.ResponseWriter, req *http.Request) {
 	if req.Body == nil {
 		log.Printf("No Body In Request %+v", req)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Bad Request")
+		writeJobsResponse(w, http.StatusBadRequest, &JobsResponse{Error: "MissingBody"})
 		return
 	}
 	defer req.Body.Close()
@@ -44,8 +71,7 @@ func (a *APIServer) JobsHandler(w http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		log.Printf("%s %+v", err, req)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Bad Request")
+		writeJobsResponse(w, http.StatusBadRequest, &JobsResponse{Error: "InvalidBody"})
 		return
 	}
 
@@ -53,26 +79,389 @@ func (a *APIServer) JobsHandler(w http.ResponseWriter, req *http.Request) {
 	err = json.Unmarshal(body, &jnl)
 	if err != nil {
 		log.Printf("%s %+v", err, req)
+		writeJobsResponse(w, http.StatusBadRequest, &JobsResponse{Error: "InvalidJSON"})
+		return
+	}
+
+	for _, job := range jnl.Jobs {
+		if !a.allowed(req, job.AppName, job.Provider) {
+			log.Printf("Forbidden %s %s %+v", job.AppName, job.Provider, req)
+			writeJobsResponse(w, http.StatusForbidden, &JobsResponse{Error: "Forbidden"})
+			return
+		}
+	}
+
+	var resp JobsResponse
+	valid := make([]*Notification, 0, len(jnl.Jobs))
+	for i, job := range jnl.Jobs {
+		errs := a.ServiceManager.Validate(job)
+		if len(errs) > 0 {
+			resp.Errors = append(resp.Errors, &JobErrors{Index: i, Errors: errs})
+			continue
+		}
+		valid = append(valid, job)
+	}
+	if len(valid) == 0 {
+		if resp.Errors == nil {
+			resp.Error = "NoJobs"
+		}
+		writeJobsResponse(w, http.StatusBadRequest, &resp)
+		return
+	}
+	jnl.Jobs = valid
+
+	log.Printf("Request: %+v Job: %+v", req, jnl)
+	err = a.processJobs(&jnl)
+	if err == ErrQueueFull || err == ErrShuttingDown {
+		log.Printf("%s, rejecting %d jobs", err, len(jnl.Jobs))
+		w.Header().Set("Retry-After", strconv.Itoa(QueueFullRetryAfter))
+		writeJobsResponse(w, http.StatusServiceUnavailable, &JobsResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("%s %+v", err, req)
+		writeJobsResponse(w, http.StatusInternalServerError, &JobsResponse{Error: "InternalServerError"})
+		return
+	}
+
+	for _, job := range jnl.Jobs {
+		resp.Jobs = append(resp.Jobs, job.Guid)
+	}
+	writeJobsResponse(w, http.StatusOK, &resp)
+}
+
+// JobHandler reports the state of a single job, GET /jobs/{id}, or
+// cancels it before its send time, DELETE /jobs/{id}.
+func (a *APIServer) JobHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method Not Allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/jobs/")
+	js, ok := a.ServiceManager.Statuses.Get(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Not Found")
+		return
+	}
+	if !a.allowed(req, js.AppName, js.Provider) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Forbidden")
+		return
+	}
+	if req.Method == "DELETE" {
+		err := a.ServiceManager.Cancel(id)
+		if err == ErrNotScheduled {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Not Scheduled")
+			return
+		}
+		if err != nil {
+			log.Printf("%s %+v", err, req)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(js)
+}
+
+// AppsHandler lists the registered apps, GET /admin/apps, or
+// registers one, POST /admin/apps. Credentials are never returned.
+func (a *APIServer) AppsHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		apps := a.ServiceManager.Registry.List()
+		redacted := make([]*App, len(apps))
+		for i, app := range apps {
+			redacted[i] = app.Redacted()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]*App{"apps": redacted})
+	case "POST":
+		a.putApp(w, req, "")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method Not Allowed")
+	}
+}
+
+// RotateRequest is the body of POST /admin/apps/{name}/rotate.
+type RotateRequest struct {
+	Provider   string      `json:"provider"`
+	Credential *Credential `json:"credential"`
+	Grace      int         `json:"grace"` // seconds the old credential stays active, optional
+}
+
+// AppHandler shows, replaces or removes a single app,
+// GET, PUT or DELETE /admin/apps/{name}.
+func (a *APIServer) AppHandler(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/admin/apps/")
+	if strings.HasSuffix(name, "/rotate") {
+		a.rotateApp(w, req, strings.TrimSuffix(name, "/rotate"))
+		return
+	}
+	switch req.Method {
+	case "GET":
+		app, ok := a.ServiceManager.Registry.Get(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Not Found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.Redacted())
+	case "PUT":
+		a.putApp(w, req, name)
+	case "DELETE":
+		ok, err := a.ServiceManager.Registry.Delete(name)
+		if err != nil {
+			log.Printf("%s %+v", err, req)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Internal Server Error")
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Not Found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method Not Allowed")
+	}
+}
+
+// rotateApp replaces the credential of an app for a provider,
+// keeping the old one active for the grace period.
+func (a *APIServer) rotateApp(w http.ResponseWriter, req *http.Request, name string) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method Not Allowed")
+		return
+	}
+	var rr RotateRequest
+	err := json.NewDecoder(req.Body).Decode(&rr)
+	if err != nil || rr.Provider == "" || rr.Credential == nil {
+		log.Printf("%v %+v", err, req)
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Bad Request")
 		return
 	}
+	grace := CredentialGrace
+	if rr.Grace > 0 {
+		grace = time.Duration(rr.Grace) * time.Second
+	}
 
-	log.Printf("Request: %+v Job: %+v", req, jnl)
-	go a.processJobs(&jnl)
-	fmt.Fprint(w, "OK")
+	app, err := a.ServiceManager.Registry.Rotate(name, rr.Provider, rr.Credential, grace)
+	if err != nil && app == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Not Found")
+		return
+	}
+	if err != nil {
+		log.Printf("%s %+v", err, req)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Internal Server Error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.Redacted())
 }
 
-func (a *APIServer) Run() {
-	http.HandleFunc("/jobs", a.JobsHandler)
-	err := http.ListenAndServe(fmt.Sprintf(":%s", a.Port), nil)
+// putApp registers the app in the request body, name is the app
+// named by the url if any.
+func (a *APIServer) putApp(w http.ResponseWriter, req *http.Request, name string) {
+	var app App
+	err := json.NewDecoder(req.Body).Decode(&app)
+	if err != nil {
+		log.Printf("%s %+v", err, req)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad Request")
+		return
+	}
+	if name != "" {
+		app.Name = name
+	}
+	err = a.ServiceManager.Registry.Put(&app)
+	if err != nil {
+		log.Printf("%s %+v", err, req)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad Request: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.Redacted())
+}
+
+// deadLetterFilter reads a filter from the app, provider, reason,
+// since and until query parameters, times in unix seconds.
+func deadLetterFilter(req *http.Request) (*DeadLetterFilter, error) {
+	q := req.URL.Query()
+	filter := &DeadLetterFilter{AppName: q.Get("app"), Provider: q.Get("provider"), Reason: q.Get("reason")}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if q.Get(param) == "" {
+			continue
+		}
+		ts, err := strconv.ParseInt(q.Get(param), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s", param)
+		}
+		*t = time.Unix(ts, 0)
+	}
+	return filter, nil
+}
+
+// DeadLettersHandler lists the dead letters matching the query,
+// GET /admin/deadletters, or purges them, DELETE /admin/deadletters.
+func (a *APIServer) DeadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	filter, err := deadLetterFilter(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad Request: %s", err)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		letters := a.ServiceManager.DeadLetters.List(filter)
+		if letters == nil {
+			letters = []*DeadLetter{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]*DeadLetter{"dead_letters": letters})
+	case "DELETE":
+		n, err := a.ServiceManager.DeadLetters.Purge(filter)
+		if err != nil {
+			log.Printf("%s %+v", err, req)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Internal Server Error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"purged": n})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method Not Allowed")
+	}
+}
+
+// DeadLetterHandler shows or removes a single dead letter,
+// GET or DELETE /admin/deadletters/{id}.
+func (a *APIServer) DeadLetterHandler(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/admin/deadletters/")
+	if strings.HasSuffix(id, "/replay") {
+		a.replayDeadLetter(w, req, strings.TrimSuffix(id, "/replay"))
+		return
+	}
+	switch req.Method {
+	case "GET":
+		dl, ok := a.ServiceManager.DeadLetters.Get(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Not Found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dl)
+	case "DELETE":
+		ok, err := a.ServiceManager.DeadLetters.Remove(id)
+		if err != nil {
+			log.Printf("%s %+v", err, req)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Internal Server Error")
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Not Found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method Not Allowed")
+	}
+}
+
+// replayDeadLetter sends a dead letter again as a new job, with the
+// payload or auth in the body if any, POST /admin/deadletters/{id}/replay.
+func (a *APIServer) replayDeadLetter(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Method Not Allowed")
+		return
+	}
+	var edit ReplayRequest
+	if req.Body != nil {
+		err := json.NewDecoder(req.Body).Decode(&edit)
+		if err != nil && err != io.EOF {
+			log.Printf("%s %+v", err, req)
+			writeJobsResponse(w, http.StatusBadRequest, &JobsResponse{Error: "InvalidJSON"})
+			return
+		}
+	}
+
+	job, errs, err := a.ServiceManager.Replay(id, &edit)
+	switch {
+	case err == ErrUnknownDeadLetter:
+		writeJobsResponse(w, http.StatusNotFound, &JobsResponse{Error: err.Error()})
+	case err == ErrQueueFull || err == ErrShuttingDown:
+		w.Header().Set("Retry-After", strconv.Itoa(QueueFullRetryAfter))
+		writeJobsResponse(w, http.StatusServiceUnavailable, &JobsResponse{Error: err.Error()})
+	case err != nil:
+		log.Printf("%s %+v", err, req)
+		writeJobsResponse(w, http.StatusInternalServerError, &JobsResponse{Error: "InternalServerError"})
+	case len(errs) > 0:
+		writeJobsResponse(w, http.StatusBadRequest, &JobsResponse{Errors: []*JobErrors{{Index: 0, Errors: errs}}})
+	default:
+		writeJobsResponse(w, http.StatusOK, &JobsResponse{Jobs: []string{job.Guid}})
+	}
+}
+
+// MetricsHandler serves the metrics in the prometheus text format.
+func (a *APIServer) MetricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := a.ServiceManager.WriteMetrics(w)
 	if err != nil {
+		log.Printf("%s %+v", err, req)
+	}
+}
+
+// Handler routes the api endpoints.
+func (a *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", a.authenticated(a.JobsHandler, false))
+	mux.HandleFunc("/jobs/", a.authenticated(a.JobHandler, false))
+	mux.HandleFunc("/metrics", a.authenticated(a.MetricsHandler, false))
+	mux.HandleFunc("/admin/apps", a.authenticated(a.AppsHandler, true))
+	mux.HandleFunc("/admin/apps/", a.authenticated(a.AppHandler, true))
+	mux.HandleFunc("/admin/deadletters", a.authenticated(a.DeadLettersHandler, true))
+	mux.HandleFunc("/admin/deadletters/", a.authenticated(a.DeadLetterHandler, true))
+	return mux
+}
+
+func (a *APIServer) Run() {
+	err := a.server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Printf("%v", err)
 	}
 }
 
+// Shutdown stops accepting connections and waits for requests
+// being handled to finish or ctx to be done.
+func (a *APIServer) Shutdown(ctx context.Context) error {
+	return a.server.Shutdown(ctx)
+}
+
 func NewAPIServer(port string, sm *ServiceManager) (*APIServer, error) {
 	log.Printf("Api Server")
-	API = &APIServer{port, sm}
+	API = &APIServer{Port: port, ServiceManager: sm}
+	API.server = &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: API.Handler()}
 	return API, nil
 }
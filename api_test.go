@@ -1,10 +1,12 @@
 package manbearpig
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewApiServer(t *testing.T) {
@@ -35,3 +37,177 @@ func TestJobHandler(t *testing.T) {
 		t.Log(w.Code, w.Body.String())
 	}
 }
+
+func TestJobHandlerQueueFull(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.PoolConfigs["gcm"] = PoolConfig{Workers: 1, QueueSize: 1}
+	ap, _ := NewAPIServer("9999", sm)
+
+	b := strings.NewReader(`{"jobs": [{"provider": "gcm", "device_tokens": ["a"], "payload": {"alert": "hi"}}, {"provider": "gcm", "device_tokens": ["b"], "payload": {"alert": "hi"}}], "auth": "abcd"}`)
+	req, err := http.NewRequest("POST", "http://localhost:9999/jobs", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	ap.JobsHandler(w, req)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 503 with Retry-After got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestJobStatusHandler(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	pushed := make(chan *Notification, 1)
+	sm.Services["test"] = testService{pushed}
+	ap, _ := NewAPIServer("9999", sm)
+	handler := ap.Handler()
+
+	b := strings.NewReader(`{"jobs": [{"provider": "test", "device_tokens": ["a"], "payload": {"alert": "hi"}}], "auth": "abcd"}`)
+	req, _ := http.NewRequest("POST", "http://localhost:9999/jobs", b)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	var accepted struct {
+		Jobs []string `json:"jobs"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &accepted)
+	if len(accepted.Jobs) != 1 {
+		t.Fatalf("Expected the job id %s", w.Body.String())
+	}
+	<-pushed
+
+	var js JobStatus
+	for i := 0; i < 100 && js.State != JobDone; i++ {
+		req, _ = http.NewRequest("GET", "http://localhost:9999/jobs/"+accepted.Jobs[0], nil)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		json.Unmarshal(w.Body.Bytes(), &js)
+		time.Sleep(time.Millisecond)
+	}
+	if js.State != JobDone || string(js.Status) != `{"ok":1}` {
+		t.Fatalf("Expected done %s", w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:9999/jobs/unknown", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 got %d", w.Code)
+	}
+}
+
+func TestAppsHandler(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	ap, _ := NewAPIServer("9999", sm)
+	handler := ap.Handler()
+
+	b := strings.NewReader(`{"name": "fart app", "credentials": {"gcm": {"auth": "abcd"}}}`)
+	req := httptest.NewRequest("POST", "/admin/apps", b)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/apps/fart%20app", nil))
+	if w.Code != 200 || strings.Contains(w.Body.String(), "abcd") {
+		t.Fatalf("Expected redacted app got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/apps/fart%20app", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/apps/fart%20app", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 got %d", w.Code)
+	}
+}
+
+func TestJobsHandlerValidation(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	pushed := make(chan *Notification, 1)
+	sm.Services["test"] = testService{pushed}
+	ap, _ := NewAPIServer("9999", sm)
+
+	b := strings.NewReader(`{"jobs": [
+		{"provider": "test", "device_tokens": ["a"], "payload": {"alert": "hi"}},
+		{"provider": "apns", "device_tokens": ["zz"], "payload": {"aps": {"badge": "1"}}},
+		{"provider": "nope", "device_tokens": ["a"], "payload": {"alert": "hi"}}
+	], "auth": "abcd"}`)
+	w := httptest.NewRecorder()
+	ap.JobsHandler(w, httptest.NewRequest("POST", "/jobs", b))
+	if w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	var resp JobsResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Jobs) != 1 || len(resp.Errors) != 2 {
+		t.Fatalf("Expected 1 job accepted and 2 rejected got %s", w.Body.String())
+	}
+	apnsErrors := resp.Errors[0]
+	if apnsErrors.Index != 1 || len(apnsErrors.Errors) != 2 ||
+		apnsErrors.Errors[0].Code != "InvalidDeviceToken" || apnsErrors.Errors[1].Code != "InvalidAPS" {
+		t.Fatalf("Expected apns token and aps errors got %s", w.Body.String())
+	}
+	if resp.Errors[1].Index != 2 || resp.Errors[1].Errors[0].Code != "UnknownProvider" {
+		t.Fatalf("Expected UnknownProvider got %s", w.Body.String())
+	}
+	<-pushed
+
+	w = httptest.NewRecorder()
+	ap.JobsHandler(w, httptest.NewRequest("POST", "/jobs", strings.NewReader(`{"jobs": [{"provider": "gcm"}]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestJobsHandlerInternalFields(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	ap, _ := NewAPIServer("9999", sm)
+
+	// Held until tomorrow so it stays in the queue.
+	sendAt := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	b := strings.NewReader(`{"jobs": [{"provider": "gcm", "device_tokens": ["a"], "payload": {"alert": "hi"},
+		"send_at": "` + sendAt + `", "guid": "mine", "retries": 100, "parent_id": "other",
+		"attempts": [{"successes": 1}]}], "auth": "abcd"}`)
+	w := httptest.NewRecorder()
+	ap.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/jobs", b))
+	if w.Code != 200 {
+		t.Fatalf("Expected the job accepted got %d %s", w.Code, w.Body.String())
+	}
+	pending, _ := sm.Queue.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("Expected the job queued got %d", len(pending))
+	}
+	job := pending[0].Job
+	if job.Guid == "mine" || job.Retries != 0 || job.ParentID != "" || len(job.Attempts) != 0 {
+		t.Fatalf("Expected fields kept by the queue reset got %+v", job)
+	}
+}
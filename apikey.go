@@ -0,0 +1,194 @@
+package manbearpig
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyHeader names the key a request is signed with.
+	APIKeyHeader string = "X-Manbearpig-Key"
+	// APITimestampHeader holds the unix time a request was signed at.
+	APITimestampHeader string = "X-Manbearpig-Timestamp"
+	// APISignatureHeader holds the hex encoded HMAC-SHA256 of
+	// "method\npath\ntimestamp\nbody", prefixed with sha256=.
+	APISignatureHeader string = "X-Manbearpig-Signature"
+	// APISignatureSkew is how far the timestamp of a signed request
+	// may be from now.
+	APISignatureSkew time.Duration = 5 * time.Minute
+)
+
+// APIKey is a client of the api. Apps and Providers limit what it may
+// send, "*" allows any. Only admin keys may use /admin.
+type APIKey struct {
+	ID        string   `json:"id"`
+	Secret    string   `json:"secret"`
+	Apps      []string `json:"apps"`
+	Providers []string `json:"providers"`
+	Admin     bool     `json:"admin,omitempty"`
+}
+
+// Allows reports whether the key may send jobs for an app and provider.
+func (k *APIKey) Allows(appName, provider string) bool {
+	return contains(k.Apps, appName) && contains(k.Providers, provider)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == "*" || v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeys holds the keys clients authenticate with.
+type APIKeys struct {
+	keys []*APIKey
+}
+
+// NewAPIKeys [...]
+func NewAPIKeys(keys ...*APIKey) (*APIKeys, error) {
+	ids := map[string]bool{}
+	for _, key := range keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, fmt.Errorf("InvalidAPIKey")
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("DuplicateAPIKey: %s", key.ID)
+		}
+		ids[key.ID] = true
+	}
+	return &APIKeys{keys: keys}, nil
+}
+
+// LoadAPIKeys reads the keys from the JSON file at path.
+//
+//	{"keys": [{"id": "web", "secret": "...", "apps": ["fart app"], "providers": ["*"]}]}
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kf struct {
+		Keys []*APIKey `json:"keys"`
+	}
+	err = json.Unmarshal(b, &kf)
+	if err != nil {
+		return nil, err
+	}
+	return NewAPIKeys(kf.Keys...)
+}
+
+// Authenticate returns the key a request was made with, either sent
+// as "Authorization: Bearer <secret>" or used to sign the request.
+// The body is read and put back for the handlers.
+func (ks *APIKeys) Authenticate(req *http.Request) (*APIKey, error) {
+	if bearer := req.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		secret := strings.TrimPrefix(bearer, "Bearer ")
+		for _, key := range ks.keys {
+			if subtle.ConstantTimeCompare([]byte(secret), []byte(key.Secret)) == 1 {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("InvalidAPIKey")
+	}
+
+	id := req.Header.Get(APIKeyHeader)
+	if id == "" {
+		return nil, fmt.Errorf("MissingAPIKey")
+	}
+	var key *APIKey
+	for _, k := range ks.keys {
+		if k.ID == id {
+			key = k
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("InvalidAPIKey")
+	}
+
+	timestamp := req.Header.Get(APITimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("InvalidTimestamp")
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > APISignatureSkew || skew < -APISignatureSkew {
+		return nil, fmt.Errorf("InvalidTimestamp")
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	expected := "sha256=" + SignRequest(key.Secret, req.Method, req.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(req.Header.Get(APISignatureHeader))) {
+		return nil, fmt.Errorf("InvalidSignature")
+	}
+	return key, nil
+}
+
+// SignRequest returns the hex encoded signature clients send in
+// APISignatureHeader. uri is the path with the query string, if any,
+// so filters like those of DELETE /admin/deadletters can't be
+// stripped from a signed request.
+func SignRequest(secret, method, uri, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", method, uri, timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type apiKeyContext struct{}
+
+// authenticated rejects requests without a valid key with 401, and
+// non admin keys with 403 when admin is set, before calling next.
+// Without any keys configured every request is let through.
+func (a *APIServer) authenticated(next http.HandlerFunc, admin bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if a.Keys == nil {
+			next(w, req)
+			return
+		}
+		key, err := a.Keys.Authenticate(req)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="manbearpig"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "Unauthorized")
+			return
+		}
+		if admin && !key.Admin {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Forbidden")
+			return
+		}
+		next(w, req.WithContext(context.WithValue(req.Context(), apiKeyContext{}, key)))
+	}
+}
+
+// allowed reports whether the key of a request may use an app and
+// provider.
+func (a *APIServer) allowed(req *http.Request, appName, provider string) bool {
+	if a.Keys == nil {
+		return true
+	}
+	key, ok := req.Context().Value(apiKeyContext{}).(*APIKey)
+	return ok && key.Allows(appName, provider)
+}
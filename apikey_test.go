@@ -0,0 +1,94 @@
+package manbearpig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	// Accepted jobs are sent, not to google.
+	sm.Services["gcm"] = rejectingService{"abcd"}
+	ap, _ := NewAPIServer("9999", sm)
+	ap.Keys, err = NewAPIKeys(
+		&APIKey{ID: "web", Secret: "s3cr3t", Apps: []string{"fart app"}, Providers: []string{"*"}},
+		&APIKey{ID: "ops", Secret: "0ps", Apps: []string{"*"}, Providers: []string{"*"}, Admin: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := ap.Handler()
+	body := `{"jobs": [{"app_name": "other app", "provider": "gcm", "device_tokens": ["a"], "payload": {"alert": "hi"}}], "auth": "abcd"}`
+
+	send := func(path, body string, header http.Header) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send("/jobs", body, nil); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a key got %d", code)
+	}
+	if code := send("/jobs", body, http.Header{"Authorization": {"Bearer wrong"}}); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with a wrong key got %d", code)
+	}
+	if code := send("/jobs", body, http.Header{"Authorization": {"Bearer s3cr3t"}}); code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for another app got %d", code)
+	}
+	if code := send("/admin/apps", `{"name": "x"}`, http.Header{"Authorization": {"Bearer s3cr3t"}}); code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for admin got %d", code)
+	}
+	if pending, _ := sm.Queue.Pending(); len(pending) != 0 {
+		t.Fatalf("Expected nothing queued got %d", len(pending))
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for metrics without a key got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 for metrics with a key got %d", w.Code)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := http.Header{
+		APIKeyHeader:       {"ops"},
+		APITimestampHeader: {timestamp},
+		APISignatureHeader: {"sha256=" + SignRequest("0ps", "POST", "/jobs", timestamp, []byte(body))},
+	}
+	if code := send("/jobs", body, signed); code != 200 {
+		t.Fatalf("Expected 200 for a signed request got %d", code)
+	}
+	if code := send("/jobs", body+" ", signed); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a modified body got %d", code)
+	}
+
+	// The query is signed too.
+	query := `{"jobs": []}`
+	signed.Set(APISignatureHeader, "sha256="+SignRequest("0ps", "POST", "/jobs?dry=1", timestamp, []byte(query)))
+	if code := send("/jobs?dry=1", query, signed); code == http.StatusUnauthorized {
+		t.Fatalf("Expected a request signed with its query accepted got %d", code)
+	}
+	if code := send("/jobs", query, signed); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without the signed query got %d", code)
+	}
+	signed.Set(APITimestampHeader, "1")
+	if code := send("/jobs", body, signed); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an old timestamp got %d", code)
+	}
+}
@@ -2,12 +2,19 @@ package manbearpig
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,6 +23,20 @@ const (
 	// MAX_POOL_SIZE is how many sockets to open for connection
 	// pooling.
 	MAX_POOL_SIZE int = 20
+	// APNSMaxStalls is how many connections in a row may fail before
+	// any frame is sent before giving up on a notification.
+	APNSMaxStalls int = 2
+	// APNSMaxPayloadSize is the largest payload of a command 2 frame.
+	APNSMaxPayloadSize int = 2048
+)
+
+// Items of a command 2 frame.
+const (
+	apnsItemDeviceToken uint8 = iota + 1
+	apnsItemPayload
+	apnsItemIdentifier
+	apnsItemExpiration
+	apnsItemPriority
 )
 
 var apnsUrls = map[string]string{
@@ -33,6 +54,7 @@ var errText = map[uint8]string{
 	6:   "Invalid Topic Size",
 	7:   "Invalid Payload Size",
 	8:   "Invalid Token",
+	10:  "Shutdown",
 	255: "None (Unknown)",
 }
 
@@ -43,28 +65,111 @@ type APNSResult struct {
 	err    error
 }
 
+// ErrCertificateNotPinned is returned when no certificate of the
+// gateway matches APNSTLS.Pins.
+var ErrCertificateNotPinned = fmt.Errorf("CertificateNotPinned")
+
+// APNSTLS configures how the gateway certificate is verified.
+type APNSTLS struct {
+	// RootCAs the gateway certificate must chain to, the system
+	// roots if nil, e.g. the CA of a local test gateway.
+	RootCAs *x509.CertPool
+	// Pins are base64 sha256 hashes of subject public keys, see
+	// SPKIPin. When set one of the verified chain must match.
+	Pins []string
+	// Insecure skips verification altogether, only for testing.
+	Insecure bool
+}
+
+// config returns the tls config for a connection to endpoint.
+func (t APNSTLS) config(cert tls.Certificate, endpoint string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   host,
+		RootCAs:      t.RootCAs,
+	}
+	if t.Insecure {
+		cfg.InsecureSkipVerify = true
+		return cfg, nil
+	}
+	if len(t.Pins) > 0 {
+		pins := t.Pins
+		cfg.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					for _, pin := range pins {
+						if SPKIPin(cert) == pin {
+							return nil
+						}
+					}
+				}
+			}
+			return ErrCertificateNotPinned
+		}
+	}
+	return cfg, nil
+}
+
+// SPKIPin returns the base64 sha256 hash of the subject public key
+// of a certificate, as used in APNSTLS.Pins.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// LoadCertPool reads the PEM certificates in the file at path.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("NoCertificates: %s", path)
+	}
+	return pool, nil
+}
+
 // APNS [...]
 type APNS struct {
-	Pool map[string]*APNSConnPool
-	mu   *sync.Mutex
+	// Gateway overrides the address of every environment, e.g. a
+	// local fake gateway.
+	Gateway string
+	// FeedbackGateway overrides the address of the feedback service.
+	FeedbackGateway string
+	TLS             APNSTLS
+	Pool            map[string]*APNSConnPool // by app, environment and certificate
+	mu              *sync.Mutex
 }
 
 // APNSConnPool for connection pooling.
 type APNSConnPool struct {
 	conn     chan *APNSConn
 	nClients int
+	closed   bool // connections released after Close are closed
+	mu       sync.Mutex
 }
 
 // APNSConn [...]
 type APNSConn struct {
-	tlsConn        *tls.Conn
-	tlsCfg         tls.Config
-	endpoint       string
+	tlsConn  *tls.Conn
+	tlsCfg   *tls.Config
+	endpoint string
+	// ReadTimeout is how long to wait for an error response after
+	// the last frame of a notification was written.
 	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
 	mu             sync.Mutex // Sync the Apns connections
-	transactionId  uint32
-	MaxPayloadSize int // default to 256 as per Apple specifications (June 9 2012)
+	transactionId  uint32     // identifier of the last frame written
+	MaxPayloadSize int        // APNSMaxPayloadSize unless set
 	connected      bool
+	// responses gets the error response of the current connection,
+	// or the error reading it if the connection is closed without one.
+	responses chan *APNSResult
 }
 
 // connect opens a socket with the APNS service if
@@ -85,15 +190,153 @@ func (client *APNSConn) connect() (err error) {
 		return err
 	}
 
-	client.tlsConn = tls.Client(conn, &client.tlsCfg)
+	client.tlsConn = tls.Client(conn, client.tlsCfg)
 	err = client.tlsConn.Handshake()
 	if err == nil {
 		client.connected = true
+		client.responses = make(chan *APNSResult, 1)
+		go client.read(client.tlsConn, client.responses)
 	}
 
 	return err
 }
 
+// read waits for the error response apple sends right before closing
+// the connection.
+func (client *APNSConn) read(conn *tls.Conn, responses chan<- *APNSResult) {
+	readb := [6]byte{}
+	_, err := io.ReadFull(conn, readb[:])
+	if err != nil {
+		responses <- &APNSResult{err: err}
+		return
+	}
+	responses <- &APNSResult{
+		status: readb[1],
+		msgId:  binary.BigEndian.Uint32(readb[2:]),
+	}
+}
+
+// send streams a frame for each token, then waits ReadTimeout for an
+// error response. Apple drops everything written after a failed frame
+// and closes the connection, so those tokens are returned to be sent
+// again on a new one.
+func (client *APNSConn) send(tokens []string, expiry uint32, priority uint8, payload []byte, ps *PushStatus) []string {
+	ids := make(map[uint32]int, len(tokens)) // frame identifier to index in tokens
+	first := client.transactionId + 1
+	written := 0
+
+	var res *APNSResult
+	for i, devToken := range tokens {
+		// Stop as soon as apple reports an error.
+		select {
+		case res = <-client.responses:
+		default:
+		}
+		if res != nil {
+			break
+		}
+
+		btoken, err := hex.DecodeString(devToken)
+		if err != nil {
+			log.Printf("%s", err)
+			ps.Errors[devToken] = err
+			written = i + 1
+			continue
+		}
+
+		client.transactionId++
+		id := client.transactionId
+		client.tlsConn.SetWriteDeadline(time.Now().Add(client.WriteTimeout))
+		_, err = client.tlsConn.Write(encodeAPNSFrame(id, expiry, priority, btoken, payload))
+		if err != nil {
+			// Sent again from this frame unless the response says otherwise.
+			log.Printf("%s", err)
+			client.connected = false
+			break
+		}
+		ids[id] = i
+		written = i + 1
+	}
+
+	if res == nil {
+		timer := time.NewTimer(client.ReadTimeout)
+		select {
+		case res = <-client.responses:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+
+	// Without an error response everything written was accepted.
+	if res == nil || res.err != nil {
+		if res != nil {
+			client.connected = false
+		}
+		for _, devToken := range tokens[:written] {
+			if _, failed := ps.Errors[devToken]; !failed {
+				ps.Successes++
+			}
+		}
+		return tokens[written:]
+	}
+
+	client.connected = false
+	i, ok := ids[res.msgId]
+	if !ok {
+		// An error for a frame written before this notification, none
+		// of its frames were taken.
+		log.Printf("Error response %d for frame %d before %d", res.status, res.msgId, first)
+		return tokens
+	}
+	accepted := tokens[:i]
+	if res.status == 0 || res.status == 10 {
+		// Shutdown, the identifier is of the last frame delivered.
+		accepted = tokens[:i+1]
+	} else {
+		log.Printf("%s %s", errText[res.status], tokens[i])
+		ps.Errors[tokens[i]] = fmt.Errorf("%s", apnsError(res.status))
+	}
+	for _, devToken := range accepted {
+		if _, failed := ps.Errors[devToken]; !failed {
+			ps.Successes++
+		}
+	}
+	return tokens[i+1:]
+}
+
+// apnsError is the error recorded for an error response status.
+func apnsError(status uint8) string {
+	text, ok := errText[status]
+	if !ok || status == 255 {
+		return "Unknown"
+	}
+	return text
+}
+
+// encodeAPNSFrame builds a command 2 frame. Priority is left out
+// when 0 so apple uses its default of 10.
+func encodeAPNSFrame(id, expiry uint32, priority uint8, token, payload []byte) []byte {
+	items := bytes.NewBuffer(make([]byte, 0, 3*5+len(token)+len(payload)+4+4+1))
+	item := func(itemID uint8, data interface{}, size int) {
+		binary.Write(items, binary.BigEndian, itemID)
+		binary.Write(items, binary.BigEndian, uint16(size))
+		binary.Write(items, binary.BigEndian, data)
+	}
+	item(apnsItemDeviceToken, token, len(token))
+	item(apnsItemPayload, payload, len(payload))
+	item(apnsItemIdentifier, id, 4)
+	item(apnsItemExpiration, expiry, 4)
+	if priority != 0 {
+		item(apnsItemPriority, priority, 1)
+	}
+
+	frame := bytes.NewBuffer(make([]byte, 0, 5+items.Len()))
+	binary.Write(frame, binary.BigEndian, uint8(2))
+	binary.Write(frame, binary.BigEndian, uint32(items.Len()))
+	frame.Write(items.Bytes())
+	return frame.Bytes()
+}
+
 // Close [...]
 func (client *APNSConn) Close() (err error) {
 	err = nil
@@ -111,15 +354,37 @@ func (p *APNSConnPool) Get() *APNSConn {
 
 // Release puts a connection back into the connection pool.
 func (p *APNSConnPool) Release(conn *APNSConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.Close()
+		return
+	}
 	p.conn <- conn
 }
 
+// Close closes the connections that are not in use, the others once
+// they are released.
+func (p *APNSConnPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for x := 0; x < p.nClients; x++ {
+		select {
+		case c := <-p.conn:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
 // NewAPNSConnPool establishes connections with the APNS service.
-func NewAPNSConnPool(certificate, key []byte) (*APNSConnPool, error) {
+func NewAPNSConnPool(certificate, key []byte, endpoint string, t APNSTLS) (*APNSConnPool, error) {
 	conn := make(chan *APNSConn, MAX_POOL_SIZE)
 	n := 0
 	for x := 0; x < MAX_POOL_SIZE; x++ {
-		c, err := NewAPNSClient(certificate, key)
+		c, err := NewAPNSClient(certificate, key, endpoint, t)
 		if err != nil {
 			// Possible errors are missing/invalid environment which would be caught earlier.
 			// Most likely invalid cert
@@ -128,181 +393,273 @@ func NewAPNSConnPool(certificate, key []byte) (*APNSConnPool, error) {
 		conn <- c
 		n++
 	}
-	return &APNSConnPool{conn, n}, nil
+	return &APNSConnPool{conn: conn, nClients: n}, nil
 }
 
 // NewClient creates a new apns connection. endpoint and certificate.
-func NewAPNSClient(certificate, key []byte) (*APNSConn, error) {
+func NewAPNSClient(certificate, key []byte, endpoint string, t APNSTLS) (*APNSConn, error) {
 	cert, err := tls.X509KeyPair(certificate, key)
 	if err != nil {
 		return nil, err
 	}
-	endpoint, ok := apnsUrls["production"]
-	if !ok {
-		return nil, fmt.Errorf("MissingEnvironment:")
+	cfg, err := t.config(cert, endpoint)
+	if err != nil {
+		return nil, err
 	}
 
 	apnsConn := &APNSConn{
-		tlsConn: nil,
-		tlsCfg: tls.Config{
-			InsecureSkipVerify: true,
-			Certificates:       []tls.Certificate{cert}},
+		tlsConn:        nil,
+		tlsCfg:         cfg,
 		endpoint:       endpoint,
 		mu:             sync.Mutex{},
 		ReadTimeout:    150 * time.Millisecond,
-		MaxPayloadSize: 256,
+		WriteTimeout:   10 * time.Second,
+		MaxPayloadSize: APNSMaxPayloadSize,
 		connected:      false,
 	}
 
 	return apnsConn, nil
 }
 
-// Push [...]
-func (a APNS) Push(notification *Notification, authKey string) *PushStatus {
-	ps := NewPushStatus(notification)
+// APNSPayload returns the body of an apns notification, the payload
+// itself encoded as JSON. The legacy form of a pre encoded string
+// under the "payload" key is passed through untouched.
+func APNSPayload(notification *Notification) ([]byte, error) {
+	if payload, ok := notification.Payload["payload"].(string); ok {
+		return []byte(payload), nil
+	}
+	return notification.Bytes()
+}
 
-	if len(notification.DeviceTokens) == 0 {
-		ps.Errors[""] = fmt.Errorf("NoDeviceTokens")
-		return ps
+// validateAPS checks the types of the aps dictionary apple knows
+// about, other keys are sent as they are. The legacy string form is
+// not looked into.
+func validateAPS(notification *Notification) []*ValidationError {
+	if _, ok := notification.Payload["payload"].(string); ok {
+		return nil
+	}
+	v, ok := notification.Payload["aps"]
+	if !ok {
+		return nil
+	}
+	aps, ok := v.(map[string]interface{})
+	if !ok {
+		return []*ValidationError{{"payload.aps", "InvalidAPS", "aps must be an object"}}
 	}
 
-	for _, devToken := range notification.DeviceTokens {
-		btoken, err := hex.DecodeString(devToken)
-		if err != nil {
-			log.Printf("%s", err)
-			ps.Errors[devToken] = err
-			return ps
+	var errs []*ValidationError
+	invalid := func(key, message string) {
+		errs = append(errs, &ValidationError{"payload.aps." + key, "InvalidAPS", message})
+	}
+	for _, key := range []string{"alert", "sound"} {
+		switch aps[key].(type) {
+		case nil, string, map[string]interface{}:
+		default:
+			invalid(key, key+" must be a string or an object")
 		}
-
-		payload, ok := notification.Payload["payload"].(string)
-		if !ok {
-			log.Printf("Invalid payload, should be string but got %T", notification.Payload)
-			ps.Errors[devToken] = fmt.Errorf("InvalidJSON")
-			return ps
+	}
+	for _, key := range []string{"category", "thread-id"} {
+		switch aps[key].(type) {
+		case nil, string:
+		default:
+			invalid(key, key+" must be a string")
 		}
-		bpayload := []byte(payload)
-
-		a.mu.Lock()
-		pool, ok := a.Pool[notification.AppName]
-		if !ok {
-			pool, err = NewAPNSConnPool([]byte(authKey), []byte(authKey))
-			if err != nil {
-				ps.Errors[""] = err
-				log.Printf("%s", err)
-				return ps
-			}
-			a.Pool[notification.AppName] = pool
+	}
+	if badge, ok := apsNumber(aps, "badge"); !ok || badge < 0 || badge != float64(int(badge)) {
+		invalid("badge", "badge must be an integer of 0 or more")
+	}
+	for _, key := range []string{"content-available", "mutable-content"} {
+		if flag, ok := apsNumber(aps, key); !ok || (flag != 0 && flag != 1) {
+			invalid(key, key+" must be 1")
 		}
-		a.mu.Unlock()
-		client := pool.Get()
-		defer pool.Release(client)
-		err = client.connect()
+	}
+	return errs
+}
+
+// apsNumber returns a number of the aps dictionary, 0 if missing. It
+// is a float64 when decoded from a request but may be an int when the
+// job is built in go.
+func apsNumber(aps map[string]interface{}, key string) (float64, bool) {
+	switch n := aps[key].(type) {
+	case nil:
+		return 0, true
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// Validate checks tokens are 32 bytes of hex, the aps dictionary and
+// that the encoded payload is at most APNSMaxPayloadSize bytes.
+func (a APNS) Validate(notification *Notification) []*ValidationError {
+	errs := validateHexTokens(notification, 32)
+	errs = append(errs, validateEnvironment(notification)...)
+	errs = append(errs, validatePriority(notification)...)
+	errs = append(errs, validateAPS(notification)...)
+	bpayload, err := APNSPayload(notification)
+	if err != nil {
+		return append(errs, &ValidationError{"payload", "InvalidPayload", err.Error()})
+	}
+	return append(errs, validatePayloadSize(len(bpayload), APNSMaxPayloadSize)...)
+}
+
+// gateway returns the address of an environment, production if
+// none is given.
+func (a APNS) gateway(environment string) (string, error) {
+	if environment == "" {
+		environment = "production"
+	}
+	endpoint, ok := apnsUrls[environment]
+	if !ok {
+		return "", fmt.Errorf("MissingEnvironment: %s", environment)
+	}
+	if a.Gateway != "" {
+		return a.Gateway, nil
+	}
+	return endpoint, nil
+}
+
+// pool returns the connection pool for an app, environment and
+// certificate, connecting on first use.
+func (a APNS) pool(appName, environment, authKey string) (*APNSConnPool, error) {
+	endpoint, err := a.gateway(environment)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if environment == "" {
+		environment = "production"
+	}
+	key := poolKey(appName, authKey) + ":" + environment
+	pool, ok := a.Pool[key]
+	if !ok {
+		var err error
+		pool, err = NewAPNSConnPool([]byte(authKey), []byte(authKey), endpoint, a.TLS)
 		if err != nil {
-			ps.Retry = true
-			ps.Errors[devToken] = err
-			return ps
+			return nil, err
 		}
+		a.Pool[key] = pool
+	}
+	return pool, nil
+}
 
-		// https://developer.apple.com/library/mac/#documentation/
-		// NetworkingInternet/Conceptual/RemoteNotificationsPG/Chapters/
-		// CommunicatingWIthAPS.html#//apple_ref/doc/uid/TP40008194-CH101-SW4
-		if len(bpayload) > client.MaxPayloadSize {
-			log.Printf("MessageTooBig: given: %v max: %v", len(bpayload), client.MaxPayloadSize)
-			ps.Errors[devToken] = fmt.Errorf("MessageTooBig")
-			return ps
+// poolKey identifies the connections of an app by its name and a
+// hash of the credentials, so a new certificate gets new connections.
+func poolKey(appName, authKey string) string {
+	sum := sha256.Sum256([]byte(authKey))
+	return appName + ":" + hex.EncodeToString(sum[:8])
+}
+
+// Retire closes the connections made with a credential that was
+// rotated out.
+func (a APNS) Retire(appName, authKey string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prefix := poolKey(appName, authKey) + ":"
+	for key, pool := range a.Pool {
+		if strings.HasPrefix(key, prefix) {
+			pool.Close()
+			delete(a.Pool, key)
 		}
+	}
+}
 
-		// build the actual pdu
-		buffer := bytes.NewBuffer([]byte{})
+// Close closes every connection pool.
+func (a APNS) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for appName, pool := range a.Pool {
+		pool.Close()
+		delete(a.Pool, appName)
+	}
+	return nil
+}
 
-		// command
-		binary.Write(buffer, binary.BigEndian, uint8(1))
+// Push [...]
+func (a APNS) Push(notification *Notification, authKey string) *PushStatus {
+	ps := NewPushStatus(notification)
 
-		// transaction id, optional
-		binary.Write(buffer, binary.BigEndian, uint32(1))
+	if len(notification.DeviceTokens) == 0 {
+		ps.Errors[""] = fmt.Errorf("NoDeviceTokens")
+		return ps
+	}
 
-		// expiration time, default 1 hour
-		expiry := notification.Expiry
-		if expiry == 0 {
-			unixNow := uint32(time.Now().Unix())
-			expiry = unixNow + 60*60
-		}
-		binary.Write(buffer, binary.BigEndian, expiry)
+	if _, ok := ParseAPNSTokenAuth(authKey); ok {
+		// The binary protocol only knows about certificates, use apns2.
+		ps.Errors[""] = fmt.Errorf("TokenAuthNotSupported")
+		return ps
+	}
 
-		// push device token
-		binary.Write(buffer, binary.BigEndian, uint16(len(btoken)))
-		binary.Write(buffer, binary.BigEndian, btoken)
+	bpayload, err := APNSPayload(notification)
+	if err != nil {
+		log.Printf("Invalid payload %s %+v", err, notification)
+		ps.Errors[""] = fmt.Errorf("InvalidJSON")
+		return ps
+	}
 
-		// push payload
-		binary.Write(buffer, binary.BigEndian, uint16(len(bpayload)))
-		binary.Write(buffer, binary.BigEndian, bpayload)
-		pdu := buffer.Bytes()
+	pool, err := a.pool(notification.AppName, notification.Environment, authKey)
+	if err != nil {
+		ps.Errors[""] = err
+		log.Printf("%s", err)
+		return ps
+	}
+	client := pool.Get()
+	defer pool.Release(client)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	// https://developer.apple.com/library/mac/#documentation/
+	// NetworkingInternet/Conceptual/RemoteNotificationsPG/Chapters/
+	// CommunicatingWIthAPS.html#//apple_ref/doc/uid/TP40008194-CH101-SW4
+	if len(bpayload) > client.MaxPayloadSize {
+		log.Printf("MessageTooBig: given: %v max: %v", len(bpayload), client.MaxPayloadSize)
+		ps.Errors[""] = fmt.Errorf("MessageTooBig")
+		return ps
+	}
 
-		// write pdu
-		client.mu.Lock()
-		defer client.mu.Unlock()
-		_, err = client.tlsConn.Write(pdu)
-		if err != nil {
-			log.Printf("%s", err)
-			client.connected = false
-			ps.Retry = true
-			ps.Errors[devToken] = fmt.Errorf("ClientNotConnected")
-			return ps
-		}
-		// wait for error pdu from the socket
-		client.tlsConn.SetReadDeadline(time.Now().Add(client.ReadTimeout))
+	// expiration time, Expiry seconds from now, default 1 hour
+	ttl := time.Duration(notification.Expiry) * time.Second
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	expiry := uint32(time.Now().Add(ttl).Unix())
 
-		readb := [6]byte{}
-		n, err := client.tlsConn.Read(readb[:])
+	pending := notification.DeviceTokens
+	stalls := 0
+	for len(pending) > 0 {
+		err = client.connect()
 		if err != nil {
-			e2, ok := err.(net.Error)
-			if ok && e2.Timeout() {
-				// Success, apns doesn't usually return a response if successful.
-				// Only issue is, is timeout length long enough (150ms) for err response.
-				ps.Successes = 1
-				return ps
+			// A gateway that can't be trusted won't be by the next try.
+			var verr *tls.CertificateVerificationError
+			if !errors.As(err, &verr) && !errors.Is(err, ErrCertificateNotPinned) {
+				if ps.Successes > 0 {
+					// Only what is left is sent again.
+					err = fmt.Errorf("ClientNotConnected")
+				} else {
+					ps.Retry = true
+				}
+			}
+			for _, devToken := range pending {
+				ps.Errors[devToken] = err
 			}
-			log.Printf("%s", err)
-			ps.Errors[devToken] = err
 			return ps
 		}
 
-		if n >= 0 {
-			var status uint8 = uint8(readb[1])
-			switch status {
-			case 0:
-				// OK
-				ps.Successes = 1
-				return ps
-			case 1:
-				// Processing errors
-				log.Printf("%s", errText[status])
-				ps.Retry = true
-				ps.Errors[devToken] = fmt.Errorf("%s", errText[status])
-				return ps
-			case 2, 3, 4, 5, 6, 7, 8:
-				//2:   "Missing Device Token",
-				//3:   "Missing Topic",
-				//4:   "Missing Payload",
-				//5:   "Invalid Token Size",
-				//6:   "Invalid Topic Size",
-				//7:   "Invalid Payload Size",
-				//8:   "Invalid Token",
-				log.Printf("%s", errText[status])
-				ps.Errors[devToken] = fmt.Errorf("%s", errText[status])
-				return ps
-			case 255:
-				log.Printf("Unknown error code %v", hex.EncodeToString(readb[:n]))
-				ps.Retry = true
-				ps.Errors[devToken] = fmt.Errorf("Unknown")
-				return ps
-			default:
-				log.Printf("Unknown error code %v", hex.EncodeToString(readb[:n]))
-				ps.Errors[devToken] = fmt.Errorf("UnknownAPNS")
+		left := client.send(pending, expiry, uint8(notification.Priority), bpayload, ps)
+		if len(left) == len(pending) {
+			// Nothing was sent, the connection keeps failing.
+			stalls++
+			if stalls > APNSMaxStalls {
+				for _, devToken := range left {
+					ps.Errors[devToken] = fmt.Errorf("ClientNotConnected")
+				}
 				return ps
 			}
 		}
+		pending = left
 	}
-
 	return ps
 }
@@ -0,0 +1,308 @@
+package manbearpig
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// APNS2MaxPayloadSize is the largest payload accepted by the
+	// HTTP/2 provider API for regular remote notifications.
+	APNS2MaxPayloadSize int = 4096
+	// APNS2MaxCollapseID is the longest apns-collapse-id.
+	APNS2MaxCollapseID int = 64
+)
+
+var apns2Urls = map[string]string{
+	"sandbox":    "https://api.sandbox.push.apple.com",
+	"production": "https://api.push.apple.com",
+}
+
+// APNS2Response is the body apple returns for a rejected notification.
+type APNS2Response struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// APNS2 sends notifications through the APNs HTTP/2 provider API.
+type APNS2 struct {
+	// Endpoint overrides the gateway url, e.g. a local HTTP/2 test server.
+	Endpoint string
+	// Client is used for every app when set instead of building
+	// one per app from the certificate passed as auth.
+	Client  *http.Client
+	Clients map[string]*http.Client
+	// Provider tokens for apps using token based auth.
+	Tokens map[string]*APNSToken
+	mu     *sync.Mutex
+}
+
+// apns2TokenClient is shared by every app using token based auth
+// since no client certificate is involved.
+var apns2TokenClient = &http.Client{Timeout: 30 * time.Second}
+
+// NewAPNS2Client creates an HTTP/2 client authenticating with the
+// given certificate and key.
+func NewAPNS2Client(certificate, key []byte) (*http.Client, error) {
+	cert, err := tls.X509KeyPair(certificate, key)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   time.Hour,
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// auth returns the http client to use for an app, creating one
+// from the auth certificate on first use. For token based auth
+// the shared client is used and the provider token is returned.
+func (a APNS2) auth(appName, authKey string) (*http.Client, *APNSToken, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tokenAuth, ok := ParseAPNSTokenAuth(authKey)
+	if ok {
+		// Keyed by the whole auth, a new key under the same key id
+		// or another team gets a new token.
+		key := poolKey(appName, authKey)
+		token, ok := a.Tokens[key]
+		if !ok {
+			var err error
+			token, err = NewAPNSToken(tokenAuth.KeyID, tokenAuth.TeamID, []byte(tokenAuth.Key))
+			if err != nil {
+				return nil, nil, err
+			}
+			a.Tokens[key] = token
+		}
+		if a.Client != nil {
+			return a.Client, token, nil
+		}
+		return apns2TokenClient, token, nil
+	}
+
+	if a.Client != nil {
+		return a.Client, nil, nil
+	}
+	key := poolKey(appName, authKey)
+	client, ok := a.Clients[key]
+	if !ok {
+		var err error
+		client, err = NewAPNS2Client([]byte(authKey), []byte(authKey))
+		if err != nil {
+			return nil, nil, err
+		}
+		a.Clients[key] = client
+	}
+	return client, nil, nil
+}
+
+// Retire drops the client or provider token made with a credential
+// that was rotated out.
+func (a APNS2) Retire(appName, authKey string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := ParseAPNSTokenAuth(authKey); ok {
+		delete(a.Tokens, poolKey(appName, authKey))
+		return
+	}
+	key := poolKey(appName, authKey)
+	if client, ok := a.Clients[key]; ok {
+		client.CloseIdleConnections()
+		delete(a.Clients, key)
+	}
+}
+
+// Close closes idle connections of every app.
+func (a APNS2) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, client := range a.Clients {
+		client.CloseIdleConnections()
+	}
+	apns2TokenClient.CloseIdleConnections()
+	return nil
+}
+
+// endpoint returns the base url requests for an environment are
+// sent to, production if none is given.
+func (a APNS2) endpoint(environment string) (string, error) {
+	if environment == "" {
+		environment = "production"
+	}
+	url, ok := apns2Urls[environment]
+	if !ok {
+		return "", fmt.Errorf("MissingEnvironment: %s", environment)
+	}
+	if a.Endpoint != "" {
+		return a.Endpoint, nil
+	}
+	return url, nil
+}
+
+// Validate [...]
+func (a APNS2) Validate(notification *Notification) []*ValidationError {
+	errs := validateHexTokens(notification, 0)
+	errs = append(errs, validateEnvironment(notification)...)
+	errs = append(errs, validatePriority(notification)...)
+	if len(notification.CollapseKey) > APNS2MaxCollapseID {
+		errs = append(errs, &ValidationError{"collapse_key", "InvalidCollapseKey", fmt.Sprintf("at most %d bytes", APNS2MaxCollapseID)})
+	}
+	errs = append(errs, validateAPS(notification)...)
+	bpayload, err := APNSPayload(notification)
+	if err != nil {
+		return append(errs, &ValidationError{"payload", "InvalidPayload", err.Error()})
+	}
+	return append(errs, validatePayloadSize(len(bpayload), APNS2MaxPayloadSize)...)
+}
+
+// Push [...]
+func (a APNS2) Push(notification *Notification, authKey string) *PushStatus {
+	ps := NewPushStatus(notification)
+
+	if len(notification.DeviceTokens) == 0 {
+		ps.Errors[""] = fmt.Errorf("NoDeviceTokens")
+		return ps
+	}
+
+	bpayload, err := APNSPayload(notification)
+	if err != nil {
+		log.Printf("Invalid payload %s %+v", err, notification)
+		ps.Errors[""] = fmt.Errorf("InvalidJSON")
+		return ps
+	}
+	if len(bpayload) > APNS2MaxPayloadSize {
+		log.Printf("MessageTooBig: given: %v max: %v", len(bpayload), APNS2MaxPayloadSize)
+		ps.Errors[""] = fmt.Errorf("MessageTooBig")
+		return ps
+	}
+
+	endpoint, err := a.endpoint(notification.Environment)
+	if err != nil {
+		ps.Errors[""] = err
+		return ps
+	}
+
+	client, token, err := a.auth(notification.AppName, authKey)
+	if err != nil {
+		log.Printf("%s", err)
+		ps.Errors[""] = err
+		return ps
+	}
+
+	for i, devToken := range notification.DeviceTokens {
+		url := fmt.Sprintf("%s/3/device/%s", endpoint, devToken)
+		request, err := http.NewRequest("POST", url, bytes.NewReader(bpayload))
+		if err != nil {
+			ps.Errors[devToken] = err
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if token != nil {
+			bearer, err := token.Bearer()
+			if err != nil {
+				log.Printf("%s", err)
+				ps.Errors[""] = err
+				return ps
+			}
+			request.Header.Set("Authorization", "bearer "+bearer)
+		}
+		if notification.Topic != "" {
+			request.Header.Set("apns-topic", notification.Topic)
+		}
+		if notification.Expiry != 0 {
+			expiry := time.Now().Add(time.Duration(notification.Expiry) * time.Second)
+			request.Header.Set("apns-expiration", strconv.FormatInt(expiry.Unix(), 10))
+		}
+		if notification.Priority != 0 {
+			request.Header.Set("apns-priority", strconv.Itoa(notification.Priority))
+		}
+		if notification.CollapseKey != "" {
+			request.Header.Set("apns-collapse-id", notification.CollapseKey)
+		}
+
+		resp, err := client.Do(request)
+		if err != nil {
+			// The connection itself failed so nothing else will get through.
+			log.Printf("%s", err)
+			if ps.Successes > 0 {
+				// Only what is left is sent again.
+				for _, token := range notification.DeviceTokens[i:] {
+					ps.Errors[token] = fmt.Errorf("Unavailable")
+				}
+				return ps
+			}
+			ps.Retry = true
+			ps.Errors[devToken] = err
+			return ps
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			resp.Body.Close()
+			ps.Successes++
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			ps.Errors[devToken] = fmt.Errorf("InvalidResponse")
+			continue
+		}
+
+		var ret APNS2Response
+		err = json.Unmarshal(body, &ret)
+		if err != nil || ret.Reason == "" {
+			log.Printf("APNS2 Push: %s %s %+v", resp.Status, body, notification)
+			ps.Errors[devToken] = fmt.Errorf("UnknownError")
+			continue
+		}
+
+		// https://developer.apple.com/documentation/usernotifications/
+		// handling-notification-responses-from-apns
+		switch resp.StatusCode {
+		case 429, 500, 503:
+			// TooManyRequests, InternalServerError, ServiceUnavailable and Shutdown
+			// are all temporary, so hold off for as long as we are told.
+			after := resp.Header.Get("Retry-After")
+			sleepFor, _ := strconv.Atoi(after)
+			if sleepFor > ps.Delay {
+				ps.Delay = sleepFor
+			}
+		case 403:
+			// Certificate or provider token problems apply to every
+			// token that is left, there is no point in trying them.
+			log.Printf("APNS2 %s %+v", ret.Reason, notification)
+			if ret.Reason == "ExpiredProviderToken" && token != nil {
+				// Sign a fresh token and try again.
+				token.Expire()
+				if ps.Successes > 0 {
+					// Only what is left is sent again.
+					for _, token := range notification.DeviceTokens[i:] {
+						ps.Errors[token] = fmt.Errorf("Unavailable")
+					}
+					return ps
+				}
+				ps.Retry = true
+			}
+			for _, token := range notification.DeviceTokens[i:] {
+				ps.Errors[token] = fmt.Errorf("%s", ret.Reason)
+			}
+			return ps
+		}
+		ps.Errors[devToken] = fmt.Errorf("%s", ret.Reason)
+	}
+
+	return ps
+}
@@ -0,0 +1,132 @@
+package manbearpig
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newAPNS2TestServer starts a local HTTP/2 server that answers
+// with the reason registered for each device token.
+func newAPNS2TestServer(t *testing.T, reasons map[string]int) (*httptest.Server, APNS2) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			t.Errorf("Expected HTTP/2 got %s", req.Proto)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if len(body) == 0 {
+			t.Errorf("Missing payload")
+		}
+		token := strings.TrimPrefix(req.URL.Path, "/3/device/")
+		if token == "drop" {
+			panic(http.ErrAbortHandler)
+		}
+		code, ok := reasons[token]
+		if !ok {
+			return
+		}
+		w.WriteHeader(code)
+		switch code {
+		case 400:
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		case 403:
+			w.Write([]byte(`{"reason":"BadCertificate"}`))
+		case 410:
+			w.Write([]byte(`{"reason":"Unregistered","timestamp":1370543104}`))
+		case 429:
+			w.Write([]byte(`{"reason":"TooManyRequests"}`))
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+
+	a := APNS2{
+		Endpoint: srv.URL,
+		Client:   srv.Client(),
+		Clients:  map[string]*http.Client{},
+		Tokens:   map[string]*APNSToken{},
+		mu:       &sync.Mutex{},
+	}
+	return srv, a
+}
+
+func TestAPNS2Push(t *testing.T) {
+	srv, a := newAPNS2TestServer(t, map[string]int{"bad": 400, "gone": 410, "busy": 429})
+	defer srv.Close()
+
+	n := &Notification{
+		AppName:      "test",
+		Provider:     "apns2",
+		DeviceTokens: []string{"good", "bad", "gone", "busy"},
+		Payload:      map[string]interface{}{"aps": map[string]interface{}{"alert": "hi"}},
+	}
+	ps := a.Push(n, "")
+	if ps.Retry {
+		t.Fatalf("Should not retry the whole notification %+v", ps)
+	}
+	if ps.Successes != 1 {
+		t.Fatalf("Expected 1 success %+v", ps)
+	}
+	expected := map[string]string{"bad": "BadDeviceToken", "gone": "Unregistered", "busy": "TooManyRequests"}
+	for token, reason := range expected {
+		err, ok := ps.Errors[token]
+		if !ok || err.Error() != reason {
+			t.Fatalf("Expected %s for %s got %v", reason, token, err)
+		}
+	}
+}
+
+func TestAPNS2PushForbidden(t *testing.T) {
+	srv, a := newAPNS2TestServer(t, map[string]int{"first": 403})
+	defer srv.Close()
+
+	n := &Notification{
+		DeviceTokens: []string{"first", "second"},
+		Payload:      map[string]interface{}{"payload": `{"aps":{"alert":"hi"}}`},
+	}
+	ps := a.Push(n, "")
+	if len(ps.Errors) != 2 || ps.Errors["second"].Error() != "BadCertificate" {
+		t.Fatalf("Expected all tokens to fail %+v", ps)
+	}
+}
+
+func TestAPNS2PushDropped(t *testing.T) {
+	srv, a := newAPNS2TestServer(t, nil)
+	defer srv.Close()
+
+	n := &Notification{
+		DeviceTokens: []string{"good", "drop", "after"},
+		Payload:      map[string]interface{}{"aps": map[string]interface{}{"alert": "hi"}},
+	}
+	ps := a.Push(n, "")
+	if ps.Retry || ps.Successes != 1 {
+		t.Fatalf("Should not send good again %+v", ps)
+	}
+	if len(ps.Errors) != 2 || ps.Errors["drop"].Error() != "Unavailable" || ps.Errors["after"].Error() != "Unavailable" {
+		t.Fatalf("Expected the tokens left to be retried %+v", ps.Errors)
+	}
+}
+
+func TestAPNS2PushNoTokens(t *testing.T) {
+	a := APNS2{Clients: map[string]*http.Client{}, mu: &sync.Mutex{}}
+	ps := a.Push(&Notification{}, "")
+	if ps.Errors[""].Error() != "NoDeviceTokens" {
+		t.Fatalf("%+v", ps)
+	}
+}
+
+func TestAPNS2Endpoint(t *testing.T) {
+	a := APNS2{}
+	if url, _ := a.endpoint("sandbox"); url != apns2Urls["sandbox"] {
+		t.Errorf("Expected the sandbox got %s", url)
+	}
+	if url, _ := a.endpoint(""); url != apns2Urls["production"] {
+		t.Errorf("Expected production got %s", url)
+	}
+	if _, err := a.endpoint("staging"); err == nil {
+		t.Error("Expected MissingEnvironment")
+	}
+}
@@ -0,0 +1,355 @@
+package manbearpig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self signed certificate and its key as a
+// single PEM, the way apns auth is sent.
+func newTestCert(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bkey}))
+}
+
+// testCertPool trusts the certificate in auth.
+func testCertPool(t *testing.T, auth string) *x509.CertPool {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(auth)) {
+		t.Fatal("No certificate")
+	}
+	return pool
+}
+
+// apnsFrame is a notification as read by the test gateway.
+type apnsFrame struct {
+	id       uint32
+	expiry   uint32
+	priority uint8
+	token    []byte
+	payload  []byte
+}
+
+// readAPNSFrame reads a command 2 frame.
+func readAPNSFrame(r io.Reader) (*apnsFrame, error) {
+	var command uint8
+	var size uint32
+	err := binary.Read(r, binary.BigEndian, &command)
+	if err != nil {
+		return nil, err
+	}
+	if command != 2 {
+		return nil, fmt.Errorf("Unexpected command %d", command)
+	}
+	binary.Read(r, binary.BigEndian, &size)
+	items := make([]byte, size)
+	_, err = io.ReadFull(r, items)
+	if err != nil {
+		return nil, err
+	}
+
+	var f apnsFrame
+	for len(items) >= 3 {
+		itemID := items[0]
+		n := int(binary.BigEndian.Uint16(items[1:3]))
+		data := items[3 : 3+n]
+		items = items[3+n:]
+		switch itemID {
+		case 1:
+			f.token = data
+		case 2:
+			f.payload = data
+		case 3:
+			f.id = binary.BigEndian.Uint32(data)
+		case 4:
+			f.expiry = binary.BigEndian.Uint32(data)
+		case 5:
+			f.priority = data[0]
+		}
+	}
+	return &f, nil
+}
+
+// newAPNSTestGateway starts a local binary protocol gateway sending
+// every notification it reads to frames. Tokens in statuses get that
+// error response, after which the connection is closed like apple does.
+func newAPNSTestGateway(t *testing.T, auth string, statuses map[string]uint8) (net.Listener, chan *apnsFrame) {
+	cert, err := tls.X509KeyPair([]byte(auth), []byte(auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan *apnsFrame, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					f, err := readAPNSFrame(conn)
+					if err != nil {
+						return
+					}
+					frames <- f
+					if status, ok := statuses[hex.EncodeToString(f.token)]; ok {
+						response := []byte{8, status, 0, 0, 0, 0}
+						binary.BigEndian.PutUint32(response[2:], f.id)
+						conn.Write(response)
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l, frames
+}
+
+func TestAPNSGateway(t *testing.T) {
+	a := APNS{Pool: map[string]*APNSConnPool{}, mu: &sync.Mutex{}}
+	for environment, expected := range map[string]string{"": apnsUrls["production"], "sandbox": apnsUrls["sandbox"]} {
+		if gateway, _ := a.gateway(environment); gateway != expected {
+			t.Errorf("Expected %s for %q got %s", expected, environment, gateway)
+		}
+	}
+	if _, err := a.gateway("staging"); err == nil {
+		t.Error("Expected MissingEnvironment")
+	}
+}
+
+func TestAPNSPush(t *testing.T) {
+	auth := newTestCert(t)
+	l, frames := newAPNSTestGateway(t, auth, nil)
+	defer l.Close()
+
+	a := APNS{Gateway: l.Addr().String(), TLS: APNSTLS{RootCAs: testCertPool(t, auth)}, Pool: map[string]*APNSConnPool{}, mu: &sync.Mutex{}}
+	defer a.Close()
+	token := strings.Repeat("ab", 32)
+	n := &Notification{
+		AppName:      "test",
+		Provider:     "apns",
+		Environment:  "sandbox",
+		Priority:     5,
+		DeviceTokens: []string{token},
+		Payload:      map[string]interface{}{"payload": `{"aps":{"alert":"hi"}}`},
+	}
+	ps := a.Push(n, auth)
+	if !ps.Ok() {
+		t.Fatalf("Expected success got %s", ps)
+	}
+
+	f := <-frames
+	if string(f.payload) != `{"aps":{"alert":"hi"}}` || len(f.token) != 32 || f.priority != 5 || f.expiry == 0 {
+		t.Fatalf("Wrong frame %+v", f)
+	}
+	if len(a.Pool) != 1 {
+		t.Fatalf("Expected a pool for the sandbox got %d", len(a.Pool))
+	}
+	n.Environment = "production"
+	n.Payload = map[string]interface{}{"aps": map[string]interface{}{"alert": "hi"}, "x": 1}
+	a.Push(n, auth)
+	f = <-frames
+	if string(f.payload) != `{"aps":{"alert":"hi"},"x":1}` {
+		t.Fatalf("Expected the structured payload encoded got %s", f.payload)
+	}
+	if len(a.Pool) != 2 {
+		t.Fatalf("Expected a pool per environment got %d", len(a.Pool))
+	}
+}
+
+func TestAPNSPushExpiry(t *testing.T) {
+	auth := newTestCert(t)
+	l, frames := newAPNSTestGateway(t, auth, nil)
+	defer l.Close()
+
+	a := APNS{Gateway: l.Addr().String(), TLS: APNSTLS{RootCAs: testCertPool(t, auth)}, Pool: map[string]*APNSConnPool{}, mu: &sync.Mutex{}}
+	defer a.Close()
+	n := &Notification{
+		AppName:      "test",
+		Provider:     "apns",
+		Environment:  "sandbox",
+		DeviceTokens: []string{strings.Repeat("ab", 32)},
+		Payload:      map[string]interface{}{"payload": `{"aps":{"alert":"hi"}}`},
+	}
+	for expiry, ttl := range map[uint32]int64{600: 600, 0: 3600} {
+		n.Expiry = expiry
+		now := time.Now().Unix()
+		ps := a.Push(n, auth)
+		if !ps.Ok() {
+			t.Fatalf("Expected success got %s", ps)
+		}
+		f := <-frames
+		if at := int64(f.expiry); at < now+ttl || at > now+ttl+5 {
+			t.Fatalf("Expected an expiry %d seconds from now for %d got %d", ttl, expiry, at-now)
+		}
+	}
+}
+
+func TestAPNSVerify(t *testing.T) {
+	auth := newTestCert(t)
+	l, frames := newAPNSTestGateway(t, auth, nil)
+	defer l.Close()
+	block, _ := pem.Decode([]byte(auth))
+	cert, _ := x509.ParseCertificate(block.Bytes)
+
+	n := &Notification{
+		AppName:      "test",
+		Provider:     "apns",
+		DeviceTokens: []string{strings.Repeat("ab", 32)},
+		Payload:      map[string]interface{}{"payload": `{}`},
+	}
+	tests := []struct {
+		tls APNSTLS
+		ok  bool
+	}{
+		{APNSTLS{}, false}, // not signed by a system root
+		{APNSTLS{RootCAs: testCertPool(t, auth)}, true},
+		{APNSTLS{RootCAs: testCertPool(t, auth), Pins: []string{SPKIPin(cert)}}, true},
+		{APNSTLS{RootCAs: testCertPool(t, auth), Pins: []string{"c29tZXRoaW5nIGVsc2U="}}, false},
+		{APNSTLS{Insecure: true}, true},
+	}
+	for i, test := range tests {
+		a := APNS{Gateway: l.Addr().String(), TLS: test.tls, Pool: map[string]*APNSConnPool{}, mu: &sync.Mutex{}}
+		ps := a.Push(n, auth)
+		a.Close()
+		if ps.Ok() != test.ok || ps.Retry {
+			t.Errorf("%d: Expected ok %v without retry got %s %v", i, test.ok, ps, ps.Retry)
+		}
+		if ps.Ok() {
+			<-frames
+		}
+	}
+}
+
+func TestAPNSPushReplay(t *testing.T) {
+	auth := newTestCert(t)
+	tokens := make([]string, 6)
+	for i := range tokens {
+		tokens[i] = strings.Repeat(fmt.Sprintf("%02x", i), 32)
+	}
+	l, frames := newAPNSTestGateway(t, auth, map[string]uint8{tokens[1]: 8, tokens[4]: 1})
+	defer l.Close()
+
+	a := APNS{Gateway: l.Addr().String(), TLS: APNSTLS{RootCAs: testCertPool(t, auth)}, Pool: map[string]*APNSConnPool{}, mu: &sync.Mutex{}}
+	defer a.Close()
+	n := &Notification{
+		AppName:      "test",
+		Provider:     "apns",
+		DeviceTokens: tokens,
+		Payload:      map[string]interface{}{"payload": `{}`},
+	}
+	ps := a.Push(n, auth)
+	if ps.Successes != 4 || len(ps.Errors) != 2 {
+		t.Fatalf("Expected 4 successes and 2 errors got %d %s", ps.Successes, ps)
+	}
+	if ps.Errors[tokens[1]].Error() != "Invalid Token" || ps.Errors[tokens[4]].Error() != "Processing Errors" {
+		t.Fatalf("Wrong errors %s", ps)
+	}
+
+	// Every token reached the gateway, the ones after a failed frame
+	// once more on a new connection, and no identifier was reused.
+	delivered := map[string]int{}
+	ids := map[uint32]bool{}
+	for drained := false; !drained; {
+		select {
+		case f := <-frames:
+			delivered[hex.EncodeToString(f.token)]++
+			if ids[f.id] {
+				t.Fatalf("Identifier %d used twice", f.id)
+			}
+			ids[f.id] = true
+		case <-time.After(100 * time.Millisecond):
+			drained = true
+		}
+	}
+	for _, token := range tokens {
+		if delivered[token] == 0 {
+			t.Fatalf("Token %s never delivered %v", token, delivered)
+		}
+	}
+}
+
+func TestAPNSFeedback(t *testing.T) {
+	auth := newTestCert(t)
+	cert, err := tls.X509KeyPair([]byte(auth), []byte(auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	token := strings.Repeat("ab", 32)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		btoken, _ := hex.DecodeString(token)
+		tuple := make([]byte, 6, 6+len(btoken))
+		binary.BigEndian.PutUint32(tuple, 1370528402)
+		binary.BigEndian.PutUint16(tuple[4:], uint16(len(btoken)))
+		conn.Write(append(tuple, btoken...))
+	}()
+
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sink := &MemorySink{}
+	sm.Sinks = append(sm.Sinks, sink)
+	sm.Services["apns"] = APNS{FeedbackGateway: l.Addr().String(), TLS: APNSTLS{RootCAs: testCertPool(t, auth)}}
+	sm.Registry.Put(&App{Name: "fart app", Credentials: map[string]*Credential{"apns": {Auth: auth, Environment: "sandbox"}}})
+	sm.readAPNSFeedback()
+
+	events := sink.Events()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event got %+v", events)
+	}
+	e := events[0]
+	if e.Type != TokenUnregistered || e.Token != token || e.AppName != "fart app" || e.Time.Unix() != 1370528402 {
+		t.Fatalf("Wrong event %+v", e)
+	}
+}
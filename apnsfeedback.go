@@ -0,0 +1,147 @@
+package manbearpig
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultFeedbackInterval is how often the feedback service is
+	// read for every app.
+	DefaultFeedbackInterval time.Duration = time.Hour
+	// apnsFeedbackTimeout bounds reading the feedback of one app.
+	apnsFeedbackTimeout time.Duration = time.Minute
+)
+
+var apnsFeedbackUrls = map[string]string{
+	"sandbox":    "feedback.sandbox.push.apple.com:2196",
+	"production": "feedback.push.apple.com:2196",
+}
+
+// APNSFeedback is a device that uninstalled the app, apple asks not
+// to push to it unless it registered again after Time.
+type APNSFeedback struct {
+	Time  time.Time
+	Token string
+}
+
+// ReadAPNSFeedback parses the timestamp/token tuples sent by the
+// feedback service until the connection is closed.
+func ReadAPNSFeedback(r io.Reader) ([]*APNSFeedback, error) {
+	var tuples []*APNSFeedback
+	for {
+		header := [6]byte{}
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			return tuples, nil
+		}
+		if err != nil {
+			return tuples, err
+		}
+		token := make([]byte, binary.BigEndian.Uint16(header[4:]))
+		_, err = io.ReadFull(r, token)
+		if err != nil {
+			return tuples, err
+		}
+		tuples = append(tuples, &APNSFeedback{
+			Time:  time.Unix(int64(binary.BigEndian.Uint32(header[:4])), 0).UTC(),
+			Token: hex.EncodeToString(token),
+		})
+	}
+}
+
+// feedbackGateway returns the feedback service address of an
+// environment, production if none is given.
+func (a APNS) feedbackGateway(environment string) (string, error) {
+	if environment == "" {
+		environment = "production"
+	}
+	endpoint, ok := apnsFeedbackUrls[environment]
+	if !ok {
+		return "", fmt.Errorf("MissingEnvironment: %s", environment)
+	}
+	if a.FeedbackGateway != "" {
+		return a.FeedbackGateway, nil
+	}
+	return endpoint, nil
+}
+
+// Feedback connects to the feedback service with an app certificate
+// and returns the tokens it reports.
+func (a APNS) Feedback(environment, authKey string) ([]*APNSFeedback, error) {
+	endpoint, err := a.feedbackGateway(environment)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair([]byte(authKey), []byte(authKey))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := a.TLS.config(cert, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: apnsFeedbackTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", endpoint, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(apnsFeedbackTimeout))
+	return ReadAPNSFeedback(conn)
+}
+
+// PollAPNSFeedback reads the feedback service for every registered
+// app with an apns certificate every interval until Quit, reporting
+// each token as TokenUnregistered.
+func (sm *ServiceManager) PollAPNSFeedback(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sm.readAPNSFeedback()
+		case <-sm.Quit:
+			return
+		}
+	}
+}
+
+// readAPNSFeedback reads the feedback service once for every app.
+func (sm *ServiceManager) readAPNSFeedback() {
+	apns, ok := sm.Services["apns"].(APNS)
+	if !ok {
+		return
+	}
+	for _, app := range sm.Registry.List() {
+		cred, ok := app.Credentials["apns"]
+		if !ok || cred.Auth == "" {
+			continue
+		}
+		if _, ok := ParseAPNSTokenAuth(cred.Auth); ok {
+			continue
+		}
+
+		tuples, err := apns.Feedback(cred.Environment, cred.Auth)
+		if err != nil {
+			log.Printf("Feedback %s: %s", app.Name, err)
+		}
+		for _, tuple := range tuples {
+			sm.feedback(&FeedbackEvent{
+				Type:     TokenUnregistered,
+				AppName:  app.Name,
+				Provider: "apns",
+				Token:    tuple.Token,
+				Reason:   "Feedback",
+				Time:     tuple.Time,
+			})
+		}
+	}
+}
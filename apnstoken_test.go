@@ -0,0 +1,137 @@
+package manbearpig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestP8(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestParseAPNSTokenAuth(t *testing.T) {
+	_, ok := ParseAPNSTokenAuth("-----BEGIN CERTIFICATE-----")
+	if ok {
+		t.Fatal("Certificate should not be token auth")
+	}
+	tokenAuth, ok := ParseAPNSTokenAuth(`{"key_id": "KEY", "team_id": "TEAM", "key": "p8"}`)
+	if !ok || tokenAuth.KeyID != "KEY" || tokenAuth.TeamID != "TEAM" {
+		t.Fatalf("%+v", tokenAuth)
+	}
+}
+
+func TestAPNSTokenBearer(t *testing.T) {
+	key, p8 := newTestP8(t)
+	token, err := NewAPNSToken("KEY", "TEAM", p8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bearer, err := token.Bearer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(bearer, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Invalid jwt %s", bearer)
+	}
+
+	var header, claims map[string]interface{}
+	b, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	json.Unmarshal(b, &header)
+	b, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(b, &claims)
+	if header["alg"] != "ES256" || header["kid"] != "KEY" || claims["iss"] != "TEAM" {
+		t.Fatalf("Invalid jwt header %v claims %v", header, claims)
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Fatal("Invalid jwt signature")
+	}
+
+	cached, _ := token.Bearer()
+	if cached != bearer {
+		t.Fatal("Token should be cached")
+	}
+
+	token.issuedAt = time.Now().Add(-APNSTokenRefresh)
+	refreshed, _ := token.Bearer()
+	if refreshed == bearer {
+		t.Fatal("Token should be refreshed")
+	}
+}
+
+func TestAPNS2PushTokenAuth(t *testing.T) {
+	_, p8 := newTestP8(t)
+	auth, _ := json.Marshal(APNSTokenAuth{KeyID: "KEY", TeamID: "TEAM", Key: string(p8)})
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "bearer ") {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"reason":"MissingProviderToken"}`))
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	a := APNS2{
+		Endpoint: srv.URL,
+		Client:   srv.Client(),
+		Clients:  map[string]*http.Client{},
+		Tokens:   map[string]*APNSToken{},
+		mu:       &sync.Mutex{},
+	}
+	n := &Notification{
+		AppName:      "test",
+		DeviceTokens: []string{"a", "b"},
+		Topic:        "com.test.app",
+		Payload:      map[string]interface{}{"aps": map[string]interface{}{"alert": "hi"}},
+	}
+	ps := a.Push(n, string(auth))
+	if !ps.Ok() || ps.Successes != 2 {
+		t.Fatalf("%+v", ps)
+	}
+	if len(a.Tokens) != 1 {
+		t.Fatalf("Token should be cached per app %+v", a.Tokens)
+	}
+
+	// A new key under the same key id gets its own token.
+	_, p8 = newTestP8(t)
+	rotated, _ := json.Marshal(APNSTokenAuth{KeyID: "KEY", TeamID: "TEAM", Key: string(p8)})
+	if ps = a.Push(n, string(rotated)); !ps.Ok() {
+		t.Fatalf("%+v", ps)
+	}
+	if len(a.Tokens) != 2 {
+		t.Fatalf("Expected a token per key got %+v", a.Tokens)
+	}
+	a.Retire("test", string(auth))
+	if _, ok := a.Tokens[poolKey("test", string(rotated))]; !ok || len(a.Tokens) != 1 {
+		t.Fatalf("Expected only the retired key's token dropped got %+v", a.Tokens)
+	}
+}
@@ -13,12 +13,51 @@ import (
 
 const (
 	c2dmServiceURL string = "http://android.apis.google.com/c2dm/send"
+	// C2DMMaxMessageSize is the limit of the encoded form, payload
+	// and device token included.
+	C2DMMaxMessageSize int = 1024
 )
 
 type C2DM struct {
 	Client *http.Client
 }
 
+// c2dmData is the form posted to c2dm for one device token.
+func c2dmData(notification *Notification, devToken string) url.Values {
+	data := url.Values{}
+	data.Set("registration_id", devToken)
+	data.Set("collapse_key", notification.AppName)
+	if notification.CollapseKey != "" {
+		data.Set("collapse_key", notification.CollapseKey)
+	}
+	//data.Set("delay_while_idle", 60*60)
+	for k, v := range notification.Payload {
+		switch k {
+		case "id":
+			continue
+		default:
+			val, ok := v.(string)
+			if ok {
+				data.Set("data."+k, val)
+			}
+		}
+	}
+	return data
+}
+
+// Validate [...]
+func (c C2DM) Validate(notification *Notification) []*ValidationError {
+	var errs []*ValidationError
+	for i, devToken := range notification.DeviceTokens {
+		if len(c2dmData(notification, devToken).Encode()) >= C2DMMaxMessageSize {
+			errs = append(errs, &ValidationError{"payload", "MessageTooBig",
+				fmt.Sprintf("message for device_tokens[%d] is over %d bytes", i, C2DMMaxMessageSize)})
+			break
+		}
+	}
+	return errs
+}
+
 // https://developers.google.com/android/c2dm/
 func (c C2DM) Push(notification *Notification, authKey string) *PushStatus {
 	ps := NewPushStatus(notification)
@@ -36,24 +75,8 @@ func (c C2DM) Push(notification *Notification, authKey string) *PushStatus {
 			return ps
 		}
 
-		data := url.Values{}
-		data.Set("registration_id", devToken)
-		data.Set("collapse_key", notification.AppName)
-		//data.Set("delay_while_idle", 60*60)
-		for k, v := range notification.Payload {
-			switch k {
-			case "id":
-				continue
-			default:
-				val, ok := v.(string)
-				if ok {
-					data.Set("data."+k, val)
-				}
-			}
-		}
-
-		enc := data.Encode()
-		if len(enc) >= 1024 {
+		enc := c2dmData(notification, devToken).Encode()
+		if len(enc) >= C2DMMaxMessageSize {
 			log.Printf("Message Too Long (1024 max): %d", len(enc))
 			ps.Errors[regid] = fmt.Errorf("MessageTooBig")
 			return ps
@@ -0,0 +1,164 @@
+package manbearpig
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// CallbackAttempts is how many times a report is posted before giving up.
+	CallbackAttempts int = 5
+	// CallbackBackoff is the wait before the first retry, doubled after each one.
+	CallbackBackoff time.Duration = 2 * time.Second
+	// CallbackSignatureHeader holds the hex encoded HMAC-SHA256 of the body.
+	CallbackSignatureHeader string = "X-Manbearpig-Signature"
+)
+
+// CallbackReport is posted to a job's callback url once it finishes.
+type CallbackReport struct {
+	ID        string `json:"id"`
+	AppName   string `json:"app_name"`
+	Provider  string `json:"provider"`
+	State     string `json:"state"`
+	Retries   int    `json:"retries"`
+	Reason    string `json:"reason,omitempty"`    // why the job was abandoned
+	ParentID  string `json:"parent_id,omitempty"` // job it was derived from, lost to a restart
+	Successes int    `json:"successes"`
+	// Tokens that should not be sent to again and why.
+	InvalidTokens map[string]string `json:"invalid_tokens,omitempty"`
+	// Tokens that failed for any other reason.
+	Errors map[string]string `json:"errors,omitempty"`
+	// Canonical ids, map[oldtoken]newtoken.
+	Updates   map[string]string `json:"updates,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// NewCallbackReport builds the report for a finished job.
+func NewCallbackReport(job *Notification, state string) *CallbackReport {
+	report := &CallbackReport{
+		ID:            job.Guid,
+		AppName:       job.AppName,
+		Provider:      job.Provider,
+		State:         state,
+		Retries:       job.Retries,
+		Reason:        job.AbandonReason,
+		ParentID:      job.ParentID,
+		InvalidTokens: map[string]string{},
+		Errors:        map[string]string{},
+		Updates:       map[string]string{},
+		Timestamp:     time.Now().Unix(),
+	}
+	if job.Status == nil {
+		return report
+	}
+
+	report.Successes = job.Status.Successes
+	for token, err := range job.Status.Errors {
+		switch feedbackErrors[err.Error()] {
+		case TokenInvalid, TokenUnregistered:
+			report.InvalidTokens[token] = err.Error()
+		default:
+			report.Errors[token] = err.Error()
+		}
+	}
+	for token, update := range job.Status.Updates {
+		report.Updates[token] = update
+	}
+	return report
+}
+
+// Callbacks posts reports to callback urls, signing the body with
+// Secret when set so receivers can check it came from us.
+type Callbacks struct {
+	Secret  string
+	Client  *http.Client
+	Backoff time.Duration
+	quit    <-chan struct{}
+}
+
+// NewCallbacks [...]
+func NewCallbacks(quit <-chan struct{}) *Callbacks {
+	return &Callbacks{
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		Backoff: CallbackBackoff,
+		quit:    quit,
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body.
+func (c *Callbacks) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send posts the report in the background, retrying with an
+// exponential backoff. Reports still waiting on shutdown are dropped.
+func (c *Callbacks) Send(url string, report *CallbackReport) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("Callback %s: %s", report.ID, err)
+		return
+	}
+	go c.deliver(url, report.ID, body)
+}
+
+// deliver posts body until it is accepted, the receiver rejects it
+// or CallbackAttempts is reached.
+func (c *Callbacks) deliver(url, id string, body []byte) {
+	backoff := c.Backoff
+	for attempt := 1; attempt <= CallbackAttempts; attempt++ {
+		err := c.post(url, body)
+		if err == nil {
+			return
+		}
+		log.Printf("Callback %s attempt %d to %s: %s", id, attempt, url, err)
+		if err == errCallbackRejected {
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-c.quit:
+			return
+		}
+	}
+	log.Printf("Callback %s to %s: giving up", id, url)
+}
+
+// errCallbackRejected means the receiver will not accept the report
+// no matter how often it is sent.
+var errCallbackRejected = fmt.Errorf("CallbackRejected")
+
+func (c *Callbacks) post(url string, body []byte) error {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return errCallbackRejected
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.Secret != "" {
+		request.Header.Set(CallbackSignatureHeader, "sha256="+c.Sign(body))
+	}
+
+	resp, err := c.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == 429 || resp.StatusCode >= 500:
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return errCallbackRejected
+}
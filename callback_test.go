@@ -0,0 +1,63 @@
+package manbearpig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewCallbackReport(t *testing.T) {
+	job := &Notification{AppName: "test", Provider: "gcm"}
+	job.Init()
+	job.Status = NewPushStatus(job)
+	job.Status.Successes = 1
+	job.Status.Errors["gone"] = fmt.Errorf("NotRegistered")
+	job.Status.Errors["big"] = fmt.Errorf("MessageTooBig")
+	job.Status.Updates["old"] = "new"
+
+	report := NewCallbackReport(job, JobFailed)
+	if report.InvalidTokens["gone"] != "NotRegistered" || report.Errors["big"] != "MessageTooBig" {
+		t.Fatalf("%+v", report)
+	}
+	if report.Updates["old"] != "new" || report.Successes != 1 || report.ID != job.Guid {
+		t.Fatalf("%+v", report)
+	}
+}
+
+func TestCallbacksSend(t *testing.T) {
+	c := NewCallbacks(make(chan struct{}))
+	c.Secret = "secret"
+	c.Backoff = time.Millisecond
+
+	received := make(chan *CallbackReport, 1)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get(CallbackSignatureHeader) != "sha256="+c.Sign(body) {
+			t.Errorf("Invalid signature %s", req.Header.Get(CallbackSignatureHeader))
+		}
+		var report CallbackReport
+		json.Unmarshal(body, &report)
+		received <- &report
+	}))
+	defer srv.Close()
+
+	c.Send(srv.URL, &CallbackReport{ID: "abc", State: JobDone})
+	select {
+	case report := <-received:
+		if report.ID != "abc" || report.State != JobDone {
+			t.Fatalf("%+v", report)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Report was not retried")
+	}
+}
@@ -0,0 +1,501 @@
+package manbearpig
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DeadLetterLimit is how many dead letters are kept, the oldest
+	// are dropped to make room.
+	DeadLetterLimit int = 10000
+)
+
+// Attempt is the outcome of one call to Service.Push for a job.
+type Attempt struct {
+	Time      time.Time         `json:"time"`
+	Successes int               `json:"successes"`
+	Errors    map[string]string `json:"errors,omitempty"` // by device token, "" for the whole job
+}
+
+// DeadLetter is a job that failed for a reason other than its device
+// tokens being invalid, kept until it is replayed or purged.
+type DeadLetter struct {
+	ID        string        `json:"id"` // guid of the job
+	Job       *Notification `json:"job"`
+	Reason    string        `json:"reason"`   // the abandon reason or error, e.g. MaxAttempts or Unauthorized
+	Attempts  []*Attempt    `json:"attempts"` // oldest first
+	CreatedAt time.Time     `json:"created_at"`
+	FailedAt  time.Time     `json:"failed_at"`
+	// Auth the job was sent with if it overrode the registered
+	// credentials, never shown by the api.
+	auth string
+}
+
+// deadLetterReason returns why a failed job is a dead letter, "" if
+// it only failed for device tokens that should not be sent to again.
+func deadLetterReason(job *Notification) string {
+	if job.AbandonReason != "" {
+		return job.AbandonReason
+	}
+	if job.Status == nil {
+		return ""
+	}
+	if err, ok := job.Status.Errors[""]; ok {
+		return err.Error()
+	}
+	var reasons []string
+	for _, err := range job.Status.Errors {
+		switch feedbackErrors[err.Error()] {
+		case TokenInvalid, TokenUnregistered:
+		default:
+			reasons = append(reasons, err.Error())
+		}
+	}
+	if len(reasons) == 0 {
+		return ""
+	}
+	sort.Strings(reasons)
+	return reasons[0]
+}
+
+// NewDeadLetter keeps a copy of job with only the device tokens that
+// failed, so devices that got it are not sent it again by Replay. Its
+// attempts are moved to the dead letter.
+func NewDeadLetter(job *Notification, auth, reason string) *DeadLetter {
+	cp := *job
+	cp.DeviceTokens = failedTokens(job)
+	cp.Attempts = nil
+	cp.Status = nil
+	return &DeadLetter{
+		ID:        job.Guid,
+		Job:       &cp,
+		Reason:    reason,
+		Attempts:  job.Attempts,
+		CreatedAt: job.CreatedAt,
+		FailedAt:  time.Now().UTC(),
+		auth:      auth,
+	}
+}
+
+// failedTokens returns the device tokens of a job that got an error,
+// every token if the whole job did.
+func failedTokens(job *Notification) []string {
+	if job.Status == nil {
+		return job.DeviceTokens
+	}
+	if _, ok := job.Status.Errors[""]; ok {
+		return job.DeviceTokens
+	}
+	var tokens []string
+	for _, devToken := range job.DeviceTokens {
+		if _, ok := job.Status.Errors[devToken]; ok {
+			tokens = append(tokens, devToken)
+		}
+	}
+	return tokens
+}
+
+// DeadLetterFilter selects dead letters, empty fields match any.
+type DeadLetterFilter struct {
+	AppName  string
+	Provider string
+	Reason   string
+	Since    time.Time // failed at or after
+	Until    time.Time // failed before
+}
+
+// Match [...]
+func (f *DeadLetterFilter) Match(dl *DeadLetter) bool {
+	switch {
+	case f.AppName != "" && dl.Job.AppName != f.AppName:
+	case f.Provider != "" && dl.Job.Provider != f.Provider:
+	case f.Reason != "" && dl.Reason != f.Reason:
+	case !f.Since.IsZero() && dl.FailedAt.Before(f.Since):
+	case !f.Until.IsZero() && !dl.FailedAt.Before(f.Until):
+	default:
+		return true
+	}
+	return false
+}
+
+// deadLetterRecord is a single line in the dead letter log.
+type deadLetterRecord struct {
+	Op     string      `json:"op"` // add/remove
+	ID     string      `json:"id"`
+	Letter *DeadLetter `json:"letter,omitempty"`
+	Auth   string      `json:"auth,omitempty"`
+	Sealed string      `json:"sealed,omitempty"` // Auth encrypted with the master key
+}
+
+// DeadLetters keeps failed jobs in memory and, when opened with a
+// path, in an append only log of JSON records like the FileQueue, so
+// they survive restarts. An auth that overrode the registered
+// credentials is logged with its letter, encrypted with the master key
+// if there is one, so Replay sends with it again.
+type DeadLetters struct {
+	path    string
+	key     []byte
+	file    *os.File
+	letters map[string]*DeadLetter
+	removes int
+	mu      sync.Mutex
+}
+
+// NewDeadLetters returns an empty in memory store.
+func NewDeadLetters() *DeadLetters {
+	return &DeadLetters{letters: map[string]*DeadLetter{}}
+}
+
+// OpenDeadLetters opens the log at path, creating it if needed, and
+// replays it. Auths are encrypted with key, or stored in plaintext if
+// it is nil.
+func OpenDeadLetters(path string, key []byte) (*DeadLetters, error) {
+	d := NewDeadLetters()
+	d.path = path
+	d.key = key
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is a write interrupted by a crash.
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		var rec deadLetterRecord
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			log.Printf("Dead letters %s: skipping corrupt record at %d: %s", path, offset, err)
+			break
+		}
+		offset += int64(len(line))
+		err = d.unseal(&rec)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		d.apply(&rec)
+	}
+
+	// Drop anything after the last good record and append from there.
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.file = f
+	return d, nil
+}
+
+// apply updates the letters with a record.
+func (d *DeadLetters) apply(rec *deadLetterRecord) {
+	switch rec.Op {
+	case "add":
+		if rec.Letter != nil && rec.Letter.Job != nil {
+			d.letters[rec.ID] = rec.Letter
+		}
+	case "remove":
+		if _, ok := d.letters[rec.ID]; ok {
+			delete(d.letters, rec.ID)
+			d.removes++
+		}
+	}
+}
+
+// added returns the record adding a letter as it is written to disk.
+func (d *DeadLetters) added(dl *DeadLetter) (*deadLetterRecord, error) {
+	rec := &deadLetterRecord{Op: "add", ID: dl.ID, Letter: dl, Auth: dl.auth}
+	if d.key != nil && rec.Auth != "" {
+		var err error
+		rec.Sealed, err = seal(d.key, []byte(rec.Auth))
+		if err != nil {
+			return nil, err
+		}
+		rec.Auth = ""
+	}
+	return rec, nil
+}
+
+// unseal gives the letter of a record read from disk its auth back.
+func (d *DeadLetters) unseal(rec *deadLetterRecord) error {
+	if rec.Letter == nil {
+		return nil
+	}
+	rec.Letter.auth = rec.Auth
+	if rec.Sealed == "" {
+		return nil
+	}
+	if d.key == nil {
+		return fmt.Errorf("MissingMasterKey")
+	}
+	auth, err := unseal(d.key, rec.Sealed)
+	if err != nil {
+		return err
+	}
+	rec.Letter.auth = string(auth)
+	return nil
+}
+
+// write appends records to the log and syncs it.
+func (d *DeadLetters) write(recs ...*deadLetterRecord) error {
+	if d.file == nil {
+		return nil
+	}
+	w := bufio.NewWriter(d.file)
+	for _, rec := range recs {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// Add stores a dead letter, dropping the oldest ones past
+// DeadLetterLimit.
+func (d *DeadLetters) Add(dl *DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rec, err := d.added(dl)
+	if err != nil {
+		return err
+	}
+	recs := []*deadLetterRecord{rec}
+	if _, ok := d.letters[dl.ID]; !ok && len(d.letters) >= DeadLetterLimit {
+		oldest := d.sorted()[:len(d.letters)-DeadLetterLimit+1]
+		for _, old := range oldest {
+			log.Printf("Dropping dead letter %s", old.ID)
+			recs = append(recs, &deadLetterRecord{Op: "remove", ID: old.ID})
+		}
+	}
+	err = d.write(recs...)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		d.apply(rec)
+	}
+	return d.compact()
+}
+
+// Get [...]
+func (d *DeadLetters) Get(id string) (*DeadLetter, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dl, ok := d.letters[id]
+	return dl, ok
+}
+
+// List returns the dead letters matching filter, oldest first.
+func (d *DeadLetters) List(filter *DeadLetterFilter) []*DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var letters []*DeadLetter
+	for _, dl := range d.sorted() {
+		if filter.Match(dl) {
+			letters = append(letters, dl)
+		}
+	}
+	return letters
+}
+
+// Purge removes the dead letters matching filter and returns how
+// many there were.
+func (d *DeadLetters) Purge(filter *DeadLetterFilter) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var recs []*deadLetterRecord
+	for _, dl := range d.sorted() {
+		if filter.Match(dl) {
+			recs = append(recs, &deadLetterRecord{Op: "remove", ID: dl.ID})
+		}
+	}
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	err := d.write(recs...)
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range recs {
+		d.apply(rec)
+	}
+	return len(recs), d.compact()
+}
+
+// Remove removes a single dead letter, ok is false if there was none.
+func (d *DeadLetters) Remove(id string) (ok bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok = d.letters[id]; !ok {
+		return false, nil
+	}
+	rec := &deadLetterRecord{Op: "remove", ID: id}
+	err = d.write(rec)
+	if err != nil {
+		return false, err
+	}
+	d.apply(rec)
+	return true, d.compact()
+}
+
+// compact rewrites the log with only the letters kept once most of
+// it is removed ones. It must be called with the lock held.
+func (d *DeadLetters) compact() error {
+	if d.file == nil || d.removes < QueueCompactThreshold || d.removes <= len(d.letters) {
+		return nil
+	}
+	tmpPath := d.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, dl := range d.sorted() {
+		rec, err := d.added(dl)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, d.path)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	d.file.Close()
+	d.file = tmp
+	d.removes = 0
+	return nil
+}
+
+// Close [...]
+func (d *DeadLetters) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
+
+// sorted returns the letters by when they failed, oldest first.
+func (d *DeadLetters) sorted() []*DeadLetter {
+	letters := make([]*DeadLetter, 0, len(d.letters))
+	for _, dl := range d.letters {
+		letters = append(letters, dl)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.Before(letters[j].FailedAt) })
+	return letters
+}
+
+// deadLetter keeps a failed job unless it only failed for its device
+// tokens.
+func (sm *ServiceManager) deadLetter(job *Notification) {
+	reason := deadLetterReason(job)
+	if reason == "" {
+		return
+	}
+	auth := ""
+	if job.Status != nil {
+		auth = job.Status.Auth
+	}
+	err := sm.DeadLetters.Add(NewDeadLetter(job, auth, reason))
+	if err != nil {
+		log.Printf("Dead letter %s: %s", job.Guid, err)
+	}
+}
+
+// ErrUnknownDeadLetter is returned when replaying a dead letter
+// that is not kept.
+var ErrUnknownDeadLetter = fmt.Errorf("UnknownDeadLetter")
+
+// ReplayRequest is the body of POST /admin/deadletters/{id}/replay,
+// every field is optional.
+type ReplayRequest struct {
+	Payload map[string]interface{} `json:"payload"` // replaces the payload of the job
+	Auth    string                 `json:"auth"`    // replaces the auth the job was sent with
+}
+
+// Replay sends a dead letter again as a new job to the device tokens
+// that failed, with the payload or auth of edit if set, and removes
+// it. The new job is validated like one sent to the api.
+func (sm *ServiceManager) Replay(id string, edit *ReplayRequest) (*Notification, []*ValidationError, error) {
+	dl, ok := sm.DeadLetters.Get(id)
+	if !ok {
+		return nil, nil, ErrUnknownDeadLetter
+	}
+	job := &Notification{
+		AppName:      dl.Job.AppName,
+		Provider:     dl.Job.Provider,
+		DeviceTokens: dl.Job.DeviceTokens,
+		Payload:      dl.Job.Payload,
+		Expiry:       dl.Job.Expiry,
+		ExtraData:    dl.Job.ExtraData,
+		Topic:        dl.Job.Topic,
+		Environment:  dl.Job.Environment,
+		Priority:     dl.Job.Priority,
+		CollapseKey:  dl.Job.CollapseKey,
+		CallbackURL:  dl.Job.CallbackURL,
+	}
+	auth := dl.auth
+	if edit != nil && edit.Payload != nil {
+		job.Payload = edit.Payload
+	}
+	if edit != nil && edit.Auth != "" {
+		auth = edit.Auth
+	}
+	if errs := sm.Validate(job); len(errs) > 0 {
+		return nil, errs, nil
+	}
+
+	err := sm.Enqueue([]*Notification{job}, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = sm.DeadLetters.Remove(id)
+	if err != nil {
+		log.Printf("Dead letter %s: %s", id, err)
+	}
+	return job, nil, nil
+}
@@ -0,0 +1,187 @@
+package manbearpig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterReason(t *testing.T) {
+	job := &Notification{Status: NewPushStatus(nil)}
+	job.Status.Errors["a"] = fmt.Errorf("NotRegistered")
+	if reason := deadLetterReason(job); reason != "" {
+		t.Fatalf("Invalid tokens alone are not dead letters got %q", reason)
+	}
+	job.Status.Errors["b"] = fmt.Errorf("MismatchSenderId")
+	if reason := deadLetterReason(job); reason != "MismatchSenderId" {
+		t.Fatalf("Expected MismatchSenderId got %q", reason)
+	}
+	job.Status.Errors[""] = fmt.Errorf("Unauthorized")
+	if reason := deadLetterReason(job); reason != "Unauthorized" {
+		t.Fatalf("Expected Unauthorized got %q", reason)
+	}
+	job.AbandonReason = AbandonMaxAttempts
+	if reason := deadLetterReason(job); reason != AbandonMaxAttempts {
+		t.Fatalf("Expected MaxAttempts got %q", reason)
+	}
+}
+
+func TestNewDeadLetterTokens(t *testing.T) {
+	job := &Notification{DeviceTokens: []string{"a", "b", "c"}, Status: NewPushStatus(nil)}
+	job.Status.Errors["b"] = fmt.Errorf("Unavailable")
+	if dl := NewDeadLetter(job, "", "MaxAttempts"); strings.Join(dl.Job.DeviceTokens, ",") != "b" {
+		t.Fatalf("Expected only b kept got %v", dl.Job.DeviceTokens)
+	}
+	job.Status.Errors[""] = fmt.Errorf("Unauthorized")
+	if dl := NewDeadLetter(job, "", "Unauthorized"); len(dl.Job.DeviceTokens) != 3 {
+		t.Fatalf("Expected every token kept got %v", dl.Job.DeviceTokens)
+	}
+	if len(job.DeviceTokens) != 3 {
+		t.Fatalf("The job itself should keep its tokens got %v", job.DeviceTokens)
+	}
+}
+
+func TestDeadLettersPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletters.log")
+
+	d, err := OpenDeadLetters(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, app := range []string{"fart app", "other app", "fart app"} {
+		job := &Notification{AppName: app, Provider: "gcm", DeviceTokens: []string{"a"}}
+		job.Init()
+		job.Attempts = []*Attempt{{Time: time.Now(), Errors: map[string]string{"": "Unauthorized"}}}
+		dl := NewDeadLetter(job, fmt.Sprintf("auth%d", i), "Unauthorized")
+		dl.FailedAt = dl.FailedAt.Add(time.Duration(i) * time.Second)
+		err = d.Add(dl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+
+	d, err = OpenDeadLetters(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	letters := d.List(&DeadLetterFilter{AppName: "fart app"})
+	if len(letters) != 2 || letters[0].auth != "auth0" || len(letters[0].Attempts) != 1 {
+		t.Fatalf("Expected 2 letters for fart app with their auth got %+v", letters)
+	}
+	b, _ := json.Marshal(letters[0])
+	if strings.Contains(string(b), "auth0") {
+		t.Fatalf("Auth should never be shown %s", b)
+	}
+
+	n, err := d.Purge(&DeadLetterFilter{Until: letters[1].FailedAt})
+	if err != nil || n != 2 {
+		t.Fatalf("Expected the 2 oldest purged got %d %v", n, err)
+	}
+	if ok, _ := d.Remove(letters[1].ID); !ok {
+		t.Fatal("Expected the last letter removed")
+	}
+	if letters := d.List(&DeadLetterFilter{}); len(letters) != 0 {
+		t.Fatalf("Expected nothing left got %+v", letters)
+	}
+}
+
+func TestDeadLettersSealed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.log")
+	key := bytes.Repeat([]byte{1}, 32)
+	d, err := OpenDeadLetters(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &Notification{AppName: "fart app", Provider: "gcm", DeviceTokens: []string{"a"}}
+	job.Init()
+	d.Add(NewDeadLetter(job, "secret auth", "Unauthorized"))
+	d.Close()
+
+	b, _ := ioutil.ReadFile(path)
+	if bytes.Contains(b, []byte("secret auth")) {
+		t.Fatalf("Expected the auth encrypted got %s", b)
+	}
+	d, err = OpenDeadLetters(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl, ok := d.Get(job.Guid)
+	d.Close()
+	if !ok || dl.auth != "secret auth" {
+		t.Fatalf("Expected the auth decrypted got %+v", dl)
+	}
+	if _, err = OpenDeadLetters(path, nil); err == nil {
+		t.Fatal("Expected MissingMasterKey")
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.Services["test"] = rejectingService{"good"}
+	ap, _ := NewAPIServer("9999", sm)
+
+	job := &Notification{AppName: "fart app", Provider: "test", DeviceTokens: []string{"a"}, Payload: map[string]interface{}{"a": 1}}
+	job.Init()
+	sm.Work(job, "bad")
+	dl, ok := sm.DeadLetters.Get(job.Guid)
+	if !ok || dl.Reason != "Unauthorized" || dl.auth != "bad" || len(dl.Attempts) != 1 {
+		t.Fatalf("Expected the rejected job kept got %+v", dl)
+	}
+
+	w := httptest.NewRecorder()
+	ap.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/admin/deadletters?app=fart+app&reason=Unauthorized", nil))
+	var list struct {
+		DeadLetters []*DeadLetter `json:"dead_letters"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != 200 || len(list.DeadLetters) != 1 || list.DeadLetters[0].ID != job.Guid {
+		t.Fatalf("Expected the letter listed got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	body := strings.NewReader(`{"auth": "good", "payload": {"b": 2}}`)
+	ap.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/admin/deadletters/"+job.Guid+"/replay", body))
+	var resp JobsResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 200 || len(resp.Jobs) != 1 {
+		t.Fatalf("Expected the letter replayed got %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := sm.DeadLetters.Get(job.Guid); ok {
+		t.Fatal("Replayed letter should be removed")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		js, ok := sm.Statuses.Get(resp.Jobs[0])
+		if ok && js.State == JobDone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Replayed job never done %+v", js)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w = httptest.NewRecorder()
+	ap.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/admin/deadletters/"+job.Guid+"/replay", nil))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 for a replayed letter got %d", w.Code)
+	}
+}
@@ -1,16 +1,39 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata" // time zones of scheduled jobs on hosts without them
 
 	"manbearpig"
 )
 
 func main() {
 	port := flag.String("port", "9999", "port to listen on")
+	queuePath := flag.String("queue", "", "file to persist accepted jobs in, in memory if empty")
+	deadLettersPath := flag.String("dead-letters", "", "file to keep failed jobs in, in memory if empty")
+	workers := flag.Int("workers", manbearpig.DefaultWorkers, "jobs sent at once per provider")
+	queueSize := flag.Int("queue-size", manbearpig.DefaultQueueSize, "jobs waiting per provider before rejecting new ones")
+	callbackSecret := flag.String("callback-secret", os.Getenv("MANBEARPIG_CALLBACK_SECRET"), "key callback reports are signed with")
+	feedbackFile := flag.String("feedback-file", "", "file invalid tokens and canonical ids are appended to as JSON lines")
+	feedbackURL := flag.String("feedback-url", "", "url invalid tokens and canonical ids are posted to")
+	appsPath := flag.String("apps", "", "file the registered apps and their credentials are kept in")
+	masterKeyPath := flag.String("master-key-file", "", "file with the base64 key credentials and stored auths are encrypted with, $"+manbearpig.MasterKeyEnv+" if empty")
+	apiKeysPath := flag.String("api-keys", "", "file with the keys clients authenticate with, no authentication if empty")
+	apnsGateway := flag.String("apns-gateway", "", "host:port apns notifications are sent to instead of apple, e.g. a fake gateway")
+	apns2Endpoint := flag.String("apns2-endpoint", "", "url apns2 notifications are sent to instead of apple")
+	apnsCA := flag.String("apns-ca", "", "PEM file with the CAs the apns gateway is verified with instead of the system roots")
+	apnsPins := flag.String("apns-pin", "", "comma separated base64 sha256 hashes of public keys the apns gateway chain must include")
+	apnsInsecure := flag.Bool("apns-insecure", false, "don't verify the apns gateway certificate, only for testing")
+	apnsFeedbackGateway := flag.String("apns-feedback-gateway", "", "host:port the apns feedback service is read from instead of apple")
+	feedbackInterval := flag.Duration("apns-feedback-interval", manbearpig.DefaultFeedbackInterval, "how often the apns feedback service is read, never if 0")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to finish sending jobs on shutdown")
 	flag.Parse()
 
 	var serviceManager *manbearpig.ServiceManager
@@ -22,20 +45,129 @@ func main() {
 		os.Exit(1)
 	}
 
+	key, err := manbearpig.LoadMasterKey(*masterKeyPath)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if *appsPath != "" {
+		if key == nil {
+			log.Printf("No master key, credentials in %s are stored in plaintext", *appsPath)
+		}
+		registry, err := manbearpig.LoadRegistry(*appsPath, key)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		serviceManager.Registry = registry
+	}
+	go serviceManager.Registry.WatchCredentials(12*time.Hour, serviceManager.Quit)
+	go serviceManager.WatchRetiredCredentials(time.Minute)
+	serviceManager.Callbacks.Secret = *callbackSecret
+	if *feedbackFile != "" {
+		sink, err := manbearpig.NewFileSink(*feedbackFile)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		serviceManager.Sinks = append(serviceManager.Sinks, sink)
+	}
+	if *feedbackURL != "" {
+		sink := manbearpig.NewWebhookSink(*feedbackURL, *callbackSecret, serviceManager.Quit)
+		serviceManager.Sinks = append(serviceManager.Sinks, sink)
+	}
+	apns := serviceManager.Services["apns"].(manbearpig.APNS)
+	apns.Gateway = *apnsGateway
+	apns.FeedbackGateway = *apnsFeedbackGateway
+	if *apnsCA != "" {
+		apns.TLS.RootCAs, err = manbearpig.LoadCertPool(*apnsCA)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if *apnsPins != "" {
+		apns.TLS.Pins = strings.Split(*apnsPins, ",")
+	}
+	if *apnsInsecure {
+		log.Println("Not verifying the apns gateway certificate")
+		apns.TLS.Insecure = true
+	}
+	serviceManager.Services["apns"] = apns
+	if *apns2Endpoint != "" {
+		apns2 := serviceManager.Services["apns2"].(manbearpig.APNS2)
+		apns2.Endpoint = *apns2Endpoint
+		serviceManager.Services["apns2"] = apns2
+	}
+	for provider := range serviceManager.Services {
+		serviceManager.PoolConfigs[provider] = manbearpig.PoolConfig{Workers: *workers, QueueSize: *queueSize}
+	}
+
+	if *queuePath != "" {
+		queue, err := manbearpig.NewFileQueue(*queuePath, key)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		serviceManager.Queue = queue
+	}
+	if *deadLettersPath != "" {
+		deadLetters, err := manbearpig.OpenDeadLetters(*deadLettersPath, key)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		serviceManager.DeadLetters = deadLetters
+	}
+	// Recovered jobs are sent straight away, everything they use is
+	// set up by now.
+	if *queuePath != "" {
+		n, err := serviceManager.Recover()
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		log.Printf("Replayed %d jobs from %s", n, *queuePath)
+	}
+
+	if *feedbackInterval > 0 {
+		go serviceManager.PollAPNSFeedback(*feedbackInterval)
+	}
+
 	log.Println("Starting API server")
 	apiServer, err := manbearpig.NewAPIServer(*port, serviceManager)
 	if err != nil {
 		log.Fatalf("%s", err)
 		os.Exit(1)
 	}
+	if *apiKeysPath != "" {
+		apiServer.Keys, err = manbearpig.LoadAPIKeys(*apiKeysPath)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+	} else {
+		log.Println("No api keys, anyone can send jobs")
+	}
 	go apiServer.Run()
 
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	select {
 	case sig := <-interrupt:
 		log.Println(sig)
-		serviceManager.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+
+		err := apiServer.Shutdown(ctx)
+		if err != nil {
+			log.Printf("API server shutdown: %s", err)
+		}
+		report, err := serviceManager.Shutdown(ctx)
+		if err != nil {
+			log.Printf("ServiceManager shutdown: %s", err)
+		}
+		if report != nil {
+			log.Printf("Shutdown with %d jobs unfinished, %d interrupted, persisted: %v",
+				len(report.Pending), report.Interrupted, report.Persisted)
+			if !report.Persisted {
+				for _, guid := range report.Pending {
+					log.Printf("Dropped job %s", guid)
+				}
+			}
+		}
 	}
 }
@@ -0,0 +1,378 @@
+package manbearpig
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	fcmServiceURL string = "https://fcm.googleapis.com"
+	fcmTokenURL   string = "https://oauth2.googleapis.com/token"
+	fcmScope      string = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+// FCMServiceAccount is the service account JSON, as downloaded from
+// the firebase console, passed as the auth string.
+type FCMServiceAccount struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
+type FCMMessage struct {
+	Message FCMMessageBody `json:"message"`
+}
+
+type FCMMessageBody struct {
+	Token        string                 `json:"token"`
+	Data         map[string]string      `json:"data,omitempty"`
+	Notification map[string]interface{} `json:"notification,omitempty"`
+	Android      map[string]interface{} `json:"android,omitempty"`
+	APNS         map[string]interface{} `json:"apns,omitempty"`
+	Webpush      map[string]interface{} `json:"webpush,omitempty"`
+}
+
+// https://firebase.google.com/docs/reference/fcm/rest/v1/ErrorCode
+type FCMErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type            string `json:"@type"`
+			ErrorCode       string `json:"errorCode"`
+			FieldViolations []struct {
+				Field       string `json:"field"`
+				Description string `json:"description"`
+			} `json:"fieldViolations"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// Code returns the most specific error code in the response.
+func (r *FCMErrorResponse) Code() string {
+	for _, detail := range r.Error.Details {
+		if detail.ErrorCode != "" {
+			return detail.ErrorCode
+		}
+	}
+	if r.Error.Status != "" {
+		return r.Error.Status
+	}
+	return "UNSPECIFIED_ERROR"
+}
+
+// InvalidToken reports whether the request was rejected for its
+// device token rather than the rest of the message.
+func (r *FCMErrorResponse) InvalidToken() bool {
+	for _, detail := range r.Error.Details {
+		for _, violation := range detail.FieldViolations {
+			if violation.Field == "message.token" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FCMAccessToken is an oauth2 token obtained for a service account.
+type FCMAccessToken struct {
+	Value   string
+	Expires time.Time
+}
+
+// FCM sends notifications through the FCM HTTP v1 API.
+type FCM struct {
+	// Endpoint overrides the FCM url, e.g. a local test server.
+	Endpoint string
+	// TokenURL overrides the oauth2 token endpoint of the service account.
+	TokenURL string
+	Client   *http.Client
+	Tokens   map[string]*FCMAccessToken
+	mu       *sync.Mutex
+}
+
+// ConvertNotification builds the v1 message for a single device token.
+// The notification, android, apns and webpush keys of the payload are
+// passed through as is. Everything else is sent as data, which FCM
+// requires to be strings, so other values are JSON encoded.
+func (f FCM) ConvertNotification(notification *Notification, devToken string) ([]byte, error) {
+	msg := FCMMessageBody{Token: devToken, Data: map[string]string{}}
+
+	for k, v := range notification.Payload {
+		block, isMap := v.(map[string]interface{})
+		switch {
+		case k == "notification" && isMap:
+			msg.Notification = block
+		case k == "android" && isMap:
+			msg.Android = block
+		case k == "apns" && isMap:
+			msg.APNS = block
+		case k == "webpush" && isMap:
+			msg.Webpush = block
+		case k == "data" && isMap:
+			for dk, dv := range block {
+				msg.Data[dk] = fcmDataString(dv)
+			}
+		default:
+			msg.Data[k] = fcmDataString(v)
+		}
+	}
+
+	if notification.Expiry != 0 {
+		if msg.Android == nil {
+			msg.Android = map[string]interface{}{}
+		}
+		if _, ok := msg.Android["ttl"]; !ok {
+			msg.Android["ttl"] = fmt.Sprintf("%ds", notification.Expiry)
+		}
+	}
+	if notification.CollapseKey != "" {
+		if msg.Android == nil {
+			msg.Android = map[string]interface{}{}
+		}
+		if _, ok := msg.Android["collapse_key"]; !ok {
+			msg.Android["collapse_key"] = notification.CollapseKey
+		}
+	}
+
+	return json.Marshal(FCMMessage{msg})
+}
+
+func fcmDataString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// accessToken returns a cached oauth2 token for the service account
+// or exchanges a signed JWT assertion for a new one.
+func (f FCM) accessToken(account *FCMServiceAccount) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token, ok := f.Tokens[account.ClientEmail]
+	if ok && time.Now().Add(time.Minute).Before(token.Expires) {
+		return token.Value, nil
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("InvalidServiceAccount")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("InvalidServiceAccount")
+		}
+	}
+
+	tokenURL := account.TokenURI
+	if f.TokenURL != "" {
+		tokenURL = f.TokenURL
+	}
+	if tokenURL == "" {
+		tokenURL = fcmTokenURL
+	}
+
+	now := time.Now()
+	header := map[string]interface{}{"kid": account.PrivateKeyID}
+	claims := map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	assertion, err := signJWT(header, claims, key)
+	if err != nil {
+		return "", err
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	data.Set("assertion", assertion)
+	resp, err := f.Client.PostForm(tokenURL, data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("FCM token exchange: %s %s", resp.Status, account.ClientEmail)
+		return "", fmt.Errorf("Unauthorized")
+	}
+
+	var ret struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ret)
+	if err != nil {
+		return "", err
+	}
+	f.Tokens[account.ClientEmail] = &FCMAccessToken{
+		Value:   ret.AccessToken,
+		Expires: now.Add(time.Duration(ret.ExpiresIn) * time.Second),
+	}
+	return ret.AccessToken, nil
+}
+
+// expire drops the cached token for the service account.
+func (f FCM) expire(account *FCMServiceAccount) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.Tokens, account.ClientEmail)
+}
+
+// Validate [...]
+func (f FCM) Validate(notification *Notification) []*ValidationError {
+	data, err := json.Marshal(notification.Payload)
+	if err != nil {
+		return []*ValidationError{{"payload", "InvalidPayload", err.Error()}}
+	}
+	errs := validatePayloadSize(len(data), GCMMaxPayloadSize)
+	return append(errs, validateTTL(notification)...)
+}
+
+func (f FCM) Push(notification *Notification, authKey string) *PushStatus {
+	ps := NewPushStatus(notification)
+	if len(notification.DeviceTokens) == 0 {
+		log.Printf("No Registration IDs given %+v", notification)
+		ps.Errors[""] = fmt.Errorf("NoDeviceTokens")
+		return ps
+	}
+
+	if len(notification.Payload) == 0 {
+		log.Printf("No Payload Defined %+v", notification)
+		ps.Errors[notification.DeviceTokens[0]] = fmt.Errorf("NoPayload")
+		return ps
+	}
+
+	var account FCMServiceAccount
+	err := json.Unmarshal([]byte(authKey), &account)
+	if err != nil || account.ProjectID == "" || account.ClientEmail == "" {
+		log.Printf("FCM invalid service account for %s", notification.AppName)
+		ps.Errors[""] = fmt.Errorf("InvalidServiceAccount")
+		return ps
+	}
+
+	accessToken, err := f.accessToken(&account)
+	if err != nil {
+		log.Printf("FCM access token: %s", err)
+		switch err.Error() {
+		case "Unauthorized", "InvalidServiceAccount":
+		default:
+			// Token endpoint unreachable.
+			ps.Retry = true
+		}
+		ps.Errors[""] = err
+		return ps
+	}
+
+	endpoint := f.Endpoint
+	if endpoint == "" {
+		endpoint = fcmServiceURL
+	}
+	sendURL := fmt.Sprintf("%s/v1/projects/%s/messages:send", endpoint, account.ProjectID)
+
+	for i, devToken := range notification.DeviceTokens {
+		b, err := f.ConvertNotification(notification, devToken)
+		if err != nil {
+			log.Printf("Invalid JSON %+v", notification)
+			ps.Errors[""] = fmt.Errorf("InvalidJSON")
+			return ps
+		}
+		request, err := http.NewRequest("POST", sendURL, bytes.NewBuffer(b))
+		if err != nil {
+			ps.Retry = true
+			ps.Errors[""] = err
+			return ps
+		}
+		request.Header.Add("Authorization", "Bearer "+accessToken)
+		request.Header.Add("Content-Type", "application/json")
+
+		resp, err := f.Client.Do(request)
+		if err != nil {
+			log.Printf("%s", err)
+			if ps.Successes > 0 {
+				// Only what is left is sent again.
+				for _, token := range notification.DeviceTokens[i:] {
+					ps.Errors[token] = fmt.Errorf("Unavailable")
+				}
+				return ps
+			}
+			ps.Retry = true
+			ps.Errors[devToken] = err
+			return ps
+		}
+
+		if resp.StatusCode == 200 {
+			resp.Body.Close()
+			ps.Successes++
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var ret FCMErrorResponse
+		if err == nil {
+			err = json.Unmarshal(body, &ret)
+		}
+		if err != nil {
+			log.Printf("FCM Push: %s %s %+v", resp.Status, body, notification)
+			ps.Errors[devToken] = fmt.Errorf("UnknownError")
+			continue
+		}
+
+		code := ret.Code()
+		if code == "INVALID_ARGUMENT" && ret.InvalidToken() {
+			// Reported like the legacy api did, so the token is removed.
+			code = "InvalidRegistration"
+		}
+		switch code {
+		case "QUOTA_EXCEEDED", "UNAVAILABLE", "INTERNAL":
+			// Temporary, hold off for as long as we are told.
+			after := resp.Header.Get("Retry-After")
+			sleepFor, _ := strconv.Atoi(after)
+			if sleepFor > ps.Delay {
+				ps.Delay = sleepFor
+			}
+		case "UNAUTHENTICATED":
+			// Our access token was rejected, get a new one and try again.
+			log.Printf("FCM Unauthenticated %s %+v", ret.Error.Message, notification)
+			f.expire(&account)
+			if ps.Successes > 0 {
+				// Only what is left is sent again.
+				for _, token := range notification.DeviceTokens[i:] {
+					ps.Errors[token] = fmt.Errorf("Unavailable")
+				}
+				return ps
+			}
+			ps.Retry = true
+			ps.Errors[devToken] = fmt.Errorf("%s", code)
+			return ps
+		case "PERMISSION_DENIED", "THIRD_PARTY_AUTH_ERROR", "SENDER_ID_MISMATCH":
+			log.Printf("FCM %s %s %+v", code, ret.Error.Message, notification)
+		}
+		ps.Errors[devToken] = fmt.Errorf("%s", code)
+	}
+
+	return ps
+}
@@ -0,0 +1,178 @@
+package manbearpig
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestServiceAccount(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, _ := json.Marshal(FCMServiceAccount{
+		Type:         "service_account",
+		ProjectID:    "fart-app",
+		PrivateKeyID: "abc",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  "push@fart-app.iam.gserviceaccount.com",
+	})
+	return string(account)
+}
+
+func TestFCMConvertNotification(t *testing.T) {
+	n := &Notification{
+		Expiry: 60,
+		Payload: map[string]interface{}{
+			"notification": map[string]interface{}{"title": "hi"},
+			"message":      "Now only: Big sale at the store!",
+			"senderId":     0,
+		},
+	}
+	b, err := FCM{}.ConvertNotification(n, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg FCMMessage
+	json.Unmarshal(b, &msg)
+	if msg.Message.Token != "token" || msg.Message.Notification["title"] != "hi" {
+		t.Fatalf("%s", b)
+	}
+	if msg.Message.Data["senderId"] != "0" || msg.Message.Android["ttl"] != "60s" {
+		t.Fatalf("%s", b)
+	}
+}
+
+func TestFCMPush(t *testing.T) {
+	exchanges := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		exchanges++
+		req.ParseForm()
+		if req.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" ||
+			len(strings.Split(req.Form.Get("assertion"), ".")) != 3 {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte(`{"access_token": "secret", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("/v1/projects/fart-app/messages:send", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"error": {"code": 401, "status": "UNAUTHENTICATED"}}`))
+			return
+		}
+		var msg FCMMessage
+		json.NewDecoder(req.Body).Decode(&msg)
+		switch msg.Message.Token {
+		case "gone":
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error": {"code": 404, "status": "NOT_FOUND", "details": [
+				{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`))
+		case "malformed":
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": {"code": 400, "status": "INVALID_ARGUMENT", "details": [
+				{"@type": "type.googleapis.com/google.rpc.BadRequest", "fieldViolations": [{"field": "message.token"}]}]}}`))
+		case "toobig":
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": {"code": 400, "status": "INVALID_ARGUMENT", "details": [
+				{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "INVALID_ARGUMENT"}]}}`))
+		case "busy":
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(429)
+			w.Write([]byte(`{"error": {"code": 429, "status": "RESOURCE_EXHAUSTED", "details": [
+				{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "QUOTA_EXCEEDED"}]}}`))
+		default:
+			w.Write([]byte(`{"name": "projects/fart-app/messages/1"}`))
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	f := FCM{
+		Endpoint: srv.URL,
+		TokenURL: srv.URL + "/token",
+		Client:   srv.Client(),
+		Tokens:   map[string]*FCMAccessToken{},
+		mu:       &sync.Mutex{},
+	}
+	n := &Notification{
+		AppName:      "fart app",
+		DeviceTokens: []string{"good", "gone", "busy", "malformed", "toobig"},
+		Payload:      map[string]interface{}{"message": "hi"},
+	}
+	auth := newTestServiceAccount(t)
+	ps := f.Push(n, auth)
+	if ps.Successes != 1 || ps.Delay != 5 {
+		t.Fatalf("%+v", ps)
+	}
+	if ps.Errors["gone"].Error() != "UNREGISTERED" || ps.Errors["busy"].Error() != "QUOTA_EXCEEDED" {
+		t.Fatalf("%+v", ps.Errors)
+	}
+	// Only a token named by the error is invalid, not every token
+	// of a bad message.
+	if ps.Errors["malformed"].Error() != "InvalidRegistration" || ps.Errors["toobig"].Error() != "INVALID_ARGUMENT" {
+		t.Fatalf("%+v", ps.Errors)
+	}
+
+	f.Push(n, auth)
+	if exchanges != 1 {
+		t.Fatalf("Access token should be cached, exchanged %d times", exchanges)
+	}
+}
+
+func TestFCMPushUnauthenticated(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"access_token": "secret", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("/v1/projects/fart-app/messages:send", func(w http.ResponseWriter, req *http.Request) {
+		var msg FCMMessage
+		json.NewDecoder(req.Body).Decode(&msg)
+		if msg.Message.Token == "stale" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"error": {"code": 401, "status": "UNAUTHENTICATED"}}`))
+			return
+		}
+		w.Write([]byte(`{"name": "projects/fart-app/messages/1"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	f := FCM{
+		Endpoint: srv.URL,
+		TokenURL: srv.URL + "/token",
+		Client:   srv.Client(),
+		Tokens:   map[string]*FCMAccessToken{},
+		mu:       &sync.Mutex{},
+	}
+	n := &Notification{DeviceTokens: []string{"good", "stale", "after"}, Payload: map[string]interface{}{"message": "hi"}}
+	ps := f.Push(n, newTestServiceAccount(t))
+	if ps.Retry || ps.Successes != 1 {
+		t.Fatalf("Should not send good again %+v", ps)
+	}
+	if len(ps.Errors) != 2 || ps.Errors["stale"].Error() != "Unavailable" || ps.Errors["after"].Error() != "Unavailable" {
+		t.Fatalf("Expected the tokens left to be retried %+v", ps.Errors)
+	}
+}
+
+func TestFCMPushInvalidServiceAccount(t *testing.T) {
+	f := FCM{Client: &http.Client{}, Tokens: map[string]*FCMAccessToken{}, mu: &sync.Mutex{}}
+	n := &Notification{DeviceTokens: []string{"a"}, Payload: map[string]interface{}{"a": "b"}}
+	ps := f.Push(n, "key=abcd")
+	if ps.Retry || ps.Errors[""].Error() != "InvalidServiceAccount" {
+		t.Fatalf("%+v", ps)
+	}
+}
@@ -0,0 +1,206 @@
+package manbearpig
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// WebhookBatchSize is the most events a WebhookSink posts at once.
+	WebhookBatchSize int = 100
+	// WebhookBufferSize is how many events a WebhookSink holds while
+	// posting before new ones are dropped.
+	WebhookBufferSize int = 10000
+	// WebhookInterval is how long a WebhookSink waits for a batch to
+	// fill before posting what it has.
+	WebhookInterval time.Duration = time.Second
+)
+
+// FeedbackType says what a FeedbackEvent is about.
+type FeedbackType string
+
+const (
+	// TokenInvalid is a malformed token or one for another app or environment.
+	TokenInvalid FeedbackType = "token_invalid"
+	// TokenUnregistered is a token for a device that uninstalled the app.
+	TokenUnregistered FeedbackType = "token_unregistered"
+	// TokenCanonicalized is a token that was replaced by NewToken.
+	TokenCanonicalized FeedbackType = "token_canonicalized"
+	// AuthRejected is an app whose credentials the provider refused.
+	AuthRejected FeedbackType = "auth_rejected"
+)
+
+// feedbackErrors maps provider errors to the event reported for them.
+var feedbackErrors = map[string]FeedbackType{
+	"InvalidRegistration": TokenInvalid,
+	"MissingRegistration": TokenInvalid,
+	"BadDeviceToken":      TokenInvalid,
+	"Invalid Token":       TokenInvalid,
+	"Invalid Token Size":  TokenInvalid,
+
+	"NotRegistered": TokenUnregistered,
+	"Unregistered":  TokenUnregistered,
+	"UNREGISTERED":  TokenUnregistered,
+
+	"Unauthorized":              AuthRejected,
+	"InvalidServiceAccount":     AuthRejected,
+	"THIRD_PARTY_AUTH_ERROR":    AuthRejected,
+	"InvalidProviderToken":      AuthRejected,
+	"MissingProviderToken":      AuthRejected,
+	"BadCertificate":            AuthRejected,
+	"BadCertificateEnvironment": AuthRejected,
+}
+
+// FeedbackEvent is something learned about a token or app while
+// pushing that the owner of the token database needs to act on.
+type FeedbackEvent struct {
+	Type     FeedbackType `json:"type"`
+	AppName  string       `json:"app_name"`
+	Provider string       `json:"provider"`
+	Token    string       `json:"token,omitempty"`
+	NewToken string       `json:"new_token,omitempty"` // only for TokenCanonicalized
+	Reason   string       `json:"reason,omitempty"`    // provider error
+	JobID    string       `json:"job_id,omitempty"`
+	Time     time.Time    `json:"time"`
+}
+
+// FeedbackSink receives the events from ProcessErrors and ProcessUpdates.
+type FeedbackSink interface {
+	Feedback(*FeedbackEvent) error
+}
+
+// FileSink appends events as JSON lines to a file.
+type FileSink struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+// NewFileSink opens path for appending, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: f}, nil
+}
+
+// Feedback [...]
+func (s *FileSink) Feedback(event *FeedbackEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+// Close [...]
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// ErrFeedbackDropped is returned by a WebhookSink that has no room
+// left for an event.
+var ErrFeedbackDropped = fmt.Errorf("FeedbackDropped")
+
+// WebhookSink posts events to a url as JSON arrays of up to
+// WebhookBatchSize, signed and retried the same way as job callbacks,
+// one batch at a time. Events still waiting on shutdown are dropped.
+type WebhookSink struct {
+	URL       string
+	callbacks *Callbacks
+	events    chan *FeedbackEvent
+}
+
+// NewWebhookSink starts a sink posting until quit is closed.
+func NewWebhookSink(url, secret string, quit <-chan struct{}) *WebhookSink {
+	callbacks := NewCallbacks(quit)
+	callbacks.Secret = secret
+	s := &WebhookSink{URL: url, callbacks: callbacks, events: make(chan *FeedbackEvent, WebhookBufferSize)}
+	go s.run(quit)
+	return s
+}
+
+// Feedback [...]
+func (s *WebhookSink) Feedback(event *FeedbackEvent) error {
+	select {
+	case s.events <- event:
+		return nil
+	default:
+		return ErrFeedbackDropped
+	}
+}
+
+// run posts the events once a batch is full or WebhookInterval
+// passed with some waiting.
+func (s *WebhookSink) run(quit <-chan struct{}) {
+	ticker := time.NewTicker(WebhookInterval)
+	defer ticker.Stop()
+	var batch []*FeedbackEvent
+	for {
+		select {
+		case event := <-s.events:
+			batch = append(batch, event)
+			if len(batch) < WebhookBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-quit:
+			return
+		}
+		b, err := json.Marshal(batch)
+		if err != nil {
+			log.Printf("Feedback %s: %s", s.URL, err)
+		} else {
+			s.callbacks.deliver(s.URL, fmt.Sprintf("feedback of %d events", len(batch)), b)
+		}
+		batch = nil
+	}
+}
+
+// MemorySink keeps events in memory, mostly useful for tests.
+type MemorySink struct {
+	events []*FeedbackEvent
+	mu     sync.Mutex
+}
+
+// Feedback [...]
+func (s *MemorySink) Feedback(event *FeedbackEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// Events returns the events received so far.
+func (s *MemorySink) Events() []*FeedbackEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]*FeedbackEvent, len(s.events))
+	copy(events, s.events)
+	return events
+}
+
+// feedback hands an event to every sink.
+func (sm *ServiceManager) feedback(event *FeedbackEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	for _, sink := range sm.Sinks {
+		err := sink.Feedback(event)
+		if err != nil {
+			log.Printf("Feedback %s %s: %s", event.Type, event.Token, err)
+		}
+	}
+}
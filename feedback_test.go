@@ -0,0 +1,132 @@
+package manbearpig
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProcessErrorsFeedback(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sink := &MemorySink{}
+	sm.Sinks = []FeedbackSink{sink}
+
+	job := &Notification{AppName: "test", Provider: "gcm"}
+	job.Init()
+	ps := NewPushStatus(job)
+	ps.Errors["gone"] = fmt.Errorf("NotRegistered")
+	ps.Errors["bad"] = fmt.Errorf("InvalidRegistration")
+	ps.Errors["big"] = fmt.Errorf("MessageTooBig")
+	ps.Updates["old"] = "new"
+	ps.ProcessErrors(job)
+	ps.ProcessUpdates()
+
+	types := map[string]FeedbackType{}
+	for _, event := range sink.Events() {
+		if event.AppName != "test" || event.JobID != job.Guid {
+			t.Fatalf("%+v", event)
+		}
+		types[event.Token] = event.Type
+	}
+	expected := map[string]FeedbackType{"gone": TokenUnregistered, "bad": TokenInvalid, "old": TokenCanonicalized}
+	if len(types) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, types)
+	}
+	for token, eventType := range expected {
+		if types[token] != eventType {
+			t.Fatalf("Expected %v got %v", expected, types)
+		}
+	}
+}
+
+func TestProcessErrorsAuthRejected(t *testing.T) {
+	sm, _ := NewServiceManager()
+	sink := &MemorySink{}
+	sm.Sinks = []FeedbackSink{sink}
+
+	job := &Notification{AppName: "test", Provider: "apns2"}
+	ps := NewPushStatus(job)
+	ps.Errors["a"] = fmt.Errorf("BadCertificate")
+	ps.Errors["b"] = fmt.Errorf("BadCertificate")
+	ps.ProcessErrors(job)
+
+	events := sink.Events()
+	if len(events) != 1 || events[0].Type != AuthRejected || events[0].Token != "" {
+		t.Fatalf("Expected a single auth event %+v", events)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feedback.jsonl")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Feedback(&FeedbackEvent{Type: TokenUnregistered, Token: "a"})
+	sink.Feedback(&FeedbackEvent{Type: TokenInvalid, Token: "b"})
+	sink.Close()
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var events []FeedbackEvent
+	for scanner.Scan() {
+		var event FeedbackEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 || events[1].Type != TokenInvalid {
+		t.Fatalf("%+v", events)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	batches := make(chan []FeedbackEvent, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		var batch []FeedbackEvent
+		json.Unmarshal(b, &batch)
+		batches <- batch
+	}))
+	defer server.Close()
+	quit := make(chan struct{})
+	defer close(quit)
+
+	sink := NewWebhookSink(server.URL, "", quit)
+	for i := 0; i <= WebhookBatchSize; i++ {
+		err := sink.Feedback(&FeedbackEvent{Type: TokenUnregistered, Token: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A full batch straight away, the rest once the interval passed.
+	for _, expected := range []int{WebhookBatchSize, 1} {
+		select {
+		case batch := <-batches:
+			if len(batch) != expected {
+				t.Fatalf("Expected %d events got %d", expected, len(batch))
+			}
+		case <-time.After(2 * WebhookInterval):
+			t.Fatalf("Timed out waiting for %d events", expected)
+		}
+	}
+
+	full := &WebhookSink{events: make(chan *FeedbackEvent, 1)}
+	full.Feedback(&FeedbackEvent{})
+	if err := full.Feedback(&FeedbackEvent{}); err != ErrFeedbackDropped {
+		t.Fatalf("Expected ErrFeedbackDropped got %v", err)
+	}
+}
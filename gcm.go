@@ -8,10 +8,19 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
 )
 
 const (
 	gcmServiceURL string = "https://android.googleapis.com/gcm/send"
+	// GCMMaxPayloadSize is the limit of the data of a gcm or fcm message.
+	GCMMaxPayloadSize int = 4096
+	// GCMMaxRegistrationIDs is the most tokens a single gcm request
+	// takes, larger jobs are sent in batches of this size.
+	GCMMaxRegistrationIDs int = 1000
+	// GCMBatchConcurrency is how many batches of a job are sent at once
+	// by default.
+	GCMBatchConcurrency int = 4
 )
 
 // http://developer.android.com/guide/google/gcm/gcm.html#send-msg
@@ -38,7 +47,11 @@ type GCMResponse struct {
 }
 
 type GCM struct {
-	Client *http.Client
+	// Endpoint overrides the GCM url, e.g. a local test server.
+	Endpoint string
+	Client   *http.Client
+	// Batches of a job sent at once, GCMBatchConcurrency if 0.
+	Concurrency int
 }
 
 // NotificationToGCM takes the notification meta and data and converts
@@ -57,10 +70,27 @@ func (g GCM) ConvertNotification(notification *Notification) ([]byte, error) {
 	if expiry != 0 {
 		gcm.TimeToLive = expiry
 	}
+	if notification.CollapseKey != "" {
+		gcm.CollapseKey = notification.CollapseKey
+	}
 
 	return json.Marshal(gcm)
 }
 
+// Validate checks the data is at most 4KB. Any number of tokens is
+// fine, they are sent in batches.
+func (g GCM) Validate(notification *Notification) []*ValidationError {
+	var errs []*ValidationError
+	data, err := json.Marshal(notification.Payload)
+	if err != nil {
+		return append(errs, &ValidationError{"payload", "InvalidPayload", err.Error()})
+	}
+	errs = append(errs, validatePayloadSize(len(data), GCMMaxPayloadSize)...)
+	return append(errs, validateTTL(notification)...)
+}
+
+// Push sends the notification in batches of GCMMaxRegistrationIDs
+// tokens, Concurrency at a time, and merges their results.
 func (g GCM) Push(notification *Notification, authKey string) *PushStatus {
 	ps := NewPushStatus(notification)
 	if len(notification.DeviceTokens) == 0 {
@@ -69,25 +99,105 @@ func (g GCM) Push(notification *Notification, authKey string) *PushStatus {
 		return ps
 	}
 
-	if len(notification.DeviceTokens) > 1000 {
-		log.Printf("Too many RegistrationIDs (1000 max): %d", len(notification.DeviceTokens))
-		ps.Errors[""] = fmt.Errorf("TooManyDeviceTokens")
-		return ps
-	}
-
 	if len(notification.Payload) == 0 {
 		log.Printf("No Payload Defined %+v", notification)
 		ps.Errors[notification.DeviceTokens[0]] = fmt.Errorf("NoPayload")
 		return ps
 	}
 
+	if len(notification.DeviceTokens) <= GCMMaxRegistrationIDs {
+		return g.send(notification, authKey)
+	}
+
+	var batches []*PushStatus
+	for start := 0; start < len(notification.DeviceTokens); start += GCMMaxRegistrationIDs {
+		end := start + GCMMaxRegistrationIDs
+		if end > len(notification.DeviceTokens) {
+			end = len(notification.DeviceTokens)
+		}
+		batch := *notification
+		batch.DeviceTokens = notification.DeviceTokens[start:end]
+		batches = append(batches, NewPushStatus(&batch))
+	}
+
+	concurrency := g.Concurrency
+	if concurrency <= 0 {
+		concurrency = GCMBatchConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, batch *Notification) {
+			defer wg.Done()
+			batches[i] = g.send(batch, authKey)
+			<-sem
+		}(i, batch.Notification)
+	}
+	wg.Wait()
+	return mergeGCMBatches(notification, batches)
+}
+
+// mergeGCMBatches combines the results of the batches of a job. An
+// error for a whole batch is kept for each of its tokens, so only
+// those are resent, unless every batch failed the same way. A batch
+// to be retried that failed with an error of its own, e.g. from the
+// connection, is reported as Unavailable.
+func mergeGCMBatches(notification *Notification, batches []*PushStatus) *PushStatus {
+	ps := NewPushStatus(notification)
+	ps.Retry = true
+	var wholeErrs []string
+	for _, batch := range batches {
+		ps.Successes += batch.Successes
+		ps.Retry = ps.Retry && batch.Retry
+		if batch.Delay > ps.Delay {
+			ps.Delay = batch.Delay
+		}
+		for devToken, update := range batch.Updates {
+			ps.Updates[devToken] = update
+		}
+		for devToken, err := range batch.Errors {
+			if devToken != "" {
+				ps.Errors[devToken] = err
+				continue
+			}
+			wholeErrs = append(wholeErrs, err.Error())
+			if batch.Retry && !retryErrors[err.Error()] {
+				err = fmt.Errorf("Unavailable")
+			}
+			for _, t := range batch.Notification.DeviceTokens {
+				ps.Errors[t] = err
+			}
+		}
+	}
+
+	if len(wholeErrs) == len(batches) {
+		same := true
+		for _, err := range wholeErrs {
+			same = same && err == wholeErrs[0]
+		}
+		if same {
+			ps.Errors = map[string]error{"": fmt.Errorf("%s", wholeErrs[0])}
+		}
+	}
+	return ps
+}
+
+// send makes a single request for at most GCMMaxRegistrationIDs tokens.
+func (g GCM) send(notification *Notification, authKey string) *PushStatus {
+	ps := NewPushStatus(notification)
 	b, err := g.ConvertNotification(notification)
 	if err != nil {
 		log.Printf("Invalid JSON %+v", notification)
 		ps.Errors[""] = fmt.Errorf("InvalidJSON")
 		return ps
 	}
-	request, err := http.NewRequest("POST", gcmServiceURL, bytes.NewBuffer(b))
+	url := gcmServiceURL
+	if g.Endpoint != "" {
+		url = g.Endpoint
+	}
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
 	if err != nil {
 		ps.Retry = true
 		ps.Errors[""] = err
@@ -182,6 +292,9 @@ func (g GCM) Push(notification *Notification, authKey string) *PushStatus {
 
 	// Iterate through the results field.
 	for i, result := range ret.Results {
+		if i >= len(notification.DeviceTokens) {
+			break
+		}
 		// If message ID is set this means the message was processed.
 		if result.MessageID != "" {
 			// If the registration id is set, this signals to update
@@ -196,7 +309,7 @@ func (g GCM) Push(notification *Notification, authKey string) *PushStatus {
 				case "NotRegistered":
 				}
 			*/
-			ps.Errors[notification.DeviceTokens[i]] = fmt.Errorf(result.Error)
+			ps.Errors[notification.DeviceTokens[i]] = fmt.Errorf("%s", result.Error)
 		}
 	}
 	return ps
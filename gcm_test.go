@@ -0,0 +1,112 @@
+package manbearpig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGCMPushBatches(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning, requests := 0, 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		running++
+		requests++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		var msg GCMMessage
+		json.NewDecoder(req.Body).Decode(&msg)
+		if len(msg.RegistrationIDs) > GCMMaxRegistrationIDs {
+			w.WriteHeader(400)
+			return
+		}
+		var ret GCMResponse
+		for _, id := range msg.RegistrationIDs {
+			if id == "down" {
+				w.WriteHeader(503)
+				return
+			}
+			result := struct {
+				MessageID      string `json:"message_id"`
+				RegistrationID string `json:"registration_id"`
+				Error          string `json:"error"`
+			}{MessageID: "1"}
+			switch {
+			case strings.HasPrefix(id, "bad"):
+				result.MessageID = ""
+				result.Error = "NotRegistered"
+				ret.Failure++
+			case strings.HasPrefix(id, "old"):
+				result.RegistrationID = "new" + id
+				ret.CanonicalIDs++
+				ret.Success++
+			default:
+				ret.Success++
+			}
+			ret.Results = append(ret.Results, result)
+		}
+		json.NewEncoder(w).Encode(ret)
+	}))
+	defer ts.Close()
+
+	tokens := make([]string, 2500)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token%d", i)
+	}
+	tokens[10] = "bad10"
+	tokens[1500] = "old1500"
+	tokens[2400] = "down" // fails the whole last batch
+
+	g := GCM{Endpoint: ts.URL, Client: ts.Client(), Concurrency: 2}
+	n := &Notification{Provider: "gcm", DeviceTokens: tokens, Payload: map[string]interface{}{"a": 1}}
+	ps := g.Push(n, "key")
+
+	if requests != 3 || maxRunning > 2 {
+		t.Fatalf("Expected 3 requests 2 at a time got %d, %d at once", requests, maxRunning)
+	}
+	if ps.Successes != 1999 || ps.Retry {
+		t.Fatalf("Expected 1999 successes without retrying the job got %d %v", ps.Successes, ps.Retry)
+	}
+	if len(ps.Errors) != 501 || ps.Errors["bad10"].Error() != "NotRegistered" || ps.Errors["token2000"].Error() != "ServiceUnavailable" {
+		t.Fatalf("Expected bad10 and the last batch to fail got %d errors", len(ps.Errors))
+	}
+	if _, ok := ps.Errors[""]; ok {
+		t.Fatal("Errors of a batch should be kept per token")
+	}
+	if ps.Updates["old1500"] != "newold1500" {
+		t.Fatalf("Expected the canonical id of old1500 got %v", ps.Updates)
+	}
+	if retry := ps.retryTokens(n); len(retry) != 500 || retry[0] != "token2000" {
+		t.Fatalf("Expected only the last batch resent got %d", len(retry))
+	}
+}
+
+func TestGCMPushBatchesFailing(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(401)
+	}))
+	defer ts.Close()
+
+	tokens := make([]string, 1500)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token%d", i)
+	}
+	g := GCM{Endpoint: ts.URL, Client: ts.Client()}
+	ps := g.Push(&Notification{Provider: "gcm", DeviceTokens: tokens, Payload: map[string]interface{}{"a": 1}}, "key")
+	if len(ps.Errors) != 1 || ps.Errors[""].Error() != "Unauthorized" || !ps.AuthRejected() {
+		t.Fatalf("Expected the whole job Unauthorized got %d errors", len(ps.Errors))
+	}
+}
@@ -0,0 +1,60 @@
+package manbearpig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// signJWT encodes the header and claims and signs them with key,
+// returning the compact serialization. ES256 and RS256 are the only
+// algorithms needed by the push providers.
+func signJWT(header, claims map[string]interface{}, key crypto.PrivateKey) (string, error) {
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		header["alg"] = "ES256"
+	case *rsa.PrivateKey:
+		header["alg"] = "RS256"
+	default:
+		return "", fmt.Errorf("UnsupportedKeyType")
+	}
+	header["typ"] = "JWT"
+
+	bheader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	bclaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(bheader) + "." +
+		base64.RawURLEncoding.EncodeToString(bclaims)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS wants the raw r || s, each padded to the curve size.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
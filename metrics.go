@@ -0,0 +1,262 @@
+package manbearpig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the push
+// latency histogram.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]uint64
+	mu     sync.Mutex
+}
+
+// NewCounterVec [...]
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: map[string]uint64{}}
+}
+
+// Add increases the counter for the label values by n.
+func (c *CounterVec) Add(n uint64, values ...string) {
+	key := labelKey(c.labels, values)
+	c.mu.Lock()
+	c.values[key] += n
+	c.mu.Unlock()
+}
+
+// Get returns the current count for the label values.
+func (c *CounterVec) Get(values ...string) uint64 {
+	key := labelKey(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, key, c.values[key])
+	}
+}
+
+// histogram is the state of one label set of a HistogramVec.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+	mu      sync.Mutex
+}
+
+// NewHistogramVec [...]
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+// Observe records a value for the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := labelKey(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		// The le label goes last, inside the braces of the other labels.
+		prefix := "{"
+		if key != "" {
+			prefix = strings.TrimSuffix(key, "}") + ","
+		}
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%sle=\"%g\"} %d\n", h.name, prefix, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", h.name, prefix, hist.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, key, hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+// labelKey renders label values as they appear in the exposition
+// format, e.g. {provider="gcm",app="fart app"}.
+func labelKey(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCredentials(app *App) []string {
+	providers := make([]string, 0, len(app.Credentials))
+	for provider := range app.Credentials {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// errorReason turns a push error into a bounded label value. The
+// provider error codes are kept, anything free form is "Other".
+func errorReason(err error) string {
+	reason := err.Error()
+	if len(reason) > 40 || strings.ContainsAny(reason, ":/\n") {
+		return "Other"
+	}
+	return reason
+}
+
+// Metrics are the counters and histograms exposed on /metrics.
+type Metrics struct {
+	Sent      *CounterVec   // device tokens pushed to, by provider and app
+	Succeeded *CounterVec   // device tokens that were accepted
+	Failed    *CounterVec   // device tokens that got an error
+	Retried   *CounterVec   // jobs scheduled to be sent again
+	Abandoned *CounterVec   // jobs given up on by their retry policy
+	Errors    *CounterVec   // errors by provider and reason
+	Duration  *HistogramVec // time spent in Service.Push by provider
+}
+
+// NewMetrics [...]
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Sent:      NewCounterVec("manbearpig_tokens_sent_total", "Device tokens pushed to.", "provider", "app"),
+		Succeeded: NewCounterVec("manbearpig_tokens_succeeded_total", "Device tokens accepted by the provider.", "provider", "app"),
+		Failed:    NewCounterVec("manbearpig_tokens_failed_total", "Device tokens rejected or failed.", "provider", "app"),
+		Retried:   NewCounterVec("manbearpig_jobs_retried_total", "Jobs scheduled to be sent again.", "provider", "app"),
+		Abandoned: NewCounterVec("manbearpig_jobs_abandoned_total", "Jobs given up on by their retry policy.", "provider", "app", "reason"),
+		Errors:    NewCounterVec("manbearpig_push_errors_total", "Push errors by reason.", "provider", "reason"),
+		Duration: NewHistogramVec("manbearpig_push_duration_seconds", "Time spent pushing a job to the provider.",
+			durationBuckets, "provider"),
+	}
+}
+
+// ObservePush records the outcome of a single call to Service.Push.
+func (m *Metrics) ObservePush(job *Notification, ps *PushStatus, took time.Duration) {
+	m.Sent.Add(uint64(len(job.DeviceTokens)), job.Provider, job.AppName)
+	m.Succeeded.Add(uint64(ps.Successes), job.Provider, job.AppName)
+	m.Failed.Add(uint64(len(ps.Errors)), job.Provider, job.AppName)
+	for _, err := range ps.Errors {
+		m.Errors.Add(1, job.Provider, errorReason(err))
+	}
+	m.Duration.Observe(took.Seconds(), job.Provider)
+}
+
+// WriteMetrics writes every metric in the prometheus text format,
+// along with gauges of the current worker pools.
+func (sm *ServiceManager) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m := sm.Metrics
+	m.Sent.write(bw)
+	m.Succeeded.write(bw)
+	m.Failed.write(bw)
+	m.Retried.write(bw)
+	m.Abandoned.write(bw)
+	m.Errors.write(bw)
+	m.Duration.write(bw)
+
+	fmt.Fprintf(bw, "# HELP manbearpig_running Calls to Service.Push in progress.\n# TYPE manbearpig_running gauge\n")
+	fmt.Fprintf(bw, "manbearpig_running %d\n", atomic.LoadInt64(&sm.Stats.Running))
+
+	fmt.Fprintf(bw, "# HELP manbearpig_retries_scheduled Jobs waiting to be sent again.\n# TYPE manbearpig_retries_scheduled gauge\n")
+	fmt.Fprintf(bw, "manbearpig_retries_scheduled %d\n", sm.Retries.Len())
+
+	fmt.Fprintf(bw, "# HELP manbearpig_jobs_scheduled Jobs waiting for their send time.\n# TYPE manbearpig_jobs_scheduled gauge\n")
+	fmt.Fprintf(bw, "manbearpig_jobs_scheduled %d\n", sm.Scheduled.Len())
+
+	fmt.Fprintf(bw, "# HELP manbearpig_credential_expiry_timestamp_seconds When the certificate of an app expires.\n# TYPE manbearpig_credential_expiry_timestamp_seconds gauge\n")
+	for _, app := range sm.Registry.List() {
+		for _, provider := range sortedCredentials(app) {
+			cred := app.Credentials[provider]
+			if cred.ExpiresAt != nil {
+				fmt.Fprintf(bw, "manbearpig_credential_expiry_timestamp_seconds%s %d\n",
+					labelKey([]string{"provider", "app"}, []string{provider, app.Name}), cred.ExpiresAt.Unix())
+			}
+		}
+	}
+
+	sm.mu.Lock()
+	providers := make([]string, 0, len(sm.pools))
+	for provider := range sm.pools {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	pools := make([]*workerPool, len(providers))
+	for i, provider := range providers {
+		pools[i] = sm.pools[provider]
+	}
+	sm.mu.Unlock()
+
+	fmt.Fprintf(bw, "# HELP manbearpig_inflight Jobs being pushed.\n# TYPE manbearpig_inflight gauge\n")
+	for i, provider := range providers {
+		fmt.Fprintf(bw, "manbearpig_inflight%s %d\n", labelKey([]string{"provider"}, []string{provider}), pools[i].Busy())
+	}
+	fmt.Fprintf(bw, "# HELP manbearpig_queue_depth Jobs waiting for a worker.\n# TYPE manbearpig_queue_depth gauge\n")
+	for i, provider := range providers {
+		fmt.Fprintf(bw, "manbearpig_queue_depth%s %d\n", labelKey([]string{"provider"}, []string{provider}), pools[i].Depth())
+	}
+	return bw.Flush()
+}
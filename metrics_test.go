@@ -0,0 +1,85 @@
+package manbearpig
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_total", "Test.", "provider", "app")
+	c.Add(2, "gcm", `fart "app"`)
+	c.Add(1, "gcm", `fart "app"`)
+
+	var b bytes.Buffer
+	c.write(&b)
+	expected := "# HELP test_total Test.\n# TYPE test_total counter\n" +
+		`test_total{provider="gcm",app="fart \"app\""} 3` + "\n"
+	if b.String() != expected {
+		t.Fatalf("Expected %q got %q", expected, b.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_seconds", "Test.", []float64{.1, 1}, "provider")
+	h.Observe(.05, "gcm")
+	h.Observe(.5, "gcm")
+	h.Observe(5, "gcm")
+
+	var b bytes.Buffer
+	h.write(&b)
+	for _, line := range []string{
+		`test_seconds_bucket{provider="gcm",le="0.1"} 1`,
+		`test_seconds_bucket{provider="gcm",le="1"} 2`,
+		`test_seconds_bucket{provider="gcm",le="+Inf"} 3`,
+		`test_seconds_sum{provider="gcm"} 5.55`,
+		`test_seconds_count{provider="gcm"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Fatalf("Missing %s in\n%s", line, b.String())
+		}
+	}
+}
+
+type errorService struct{}
+
+func (s errorService) Push(n *Notification, auth string) *PushStatus {
+	ps := NewPushStatus(n)
+	ps.Successes = 1
+	ps.Errors["b"] = fmt.Errorf("MessageTooBig")
+	ps.Errors["c"] = fmt.Errorf("dial tcp: connection refused")
+	return ps
+}
+
+func TestMetricsHandler(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.Services["test"] = errorService{}
+	ap, _ := NewAPIServer("9999", sm)
+
+	sm.Work(&Notification{AppName: "app", Provider: "test", DeviceTokens: []string{"a", "b", "c"}}, "abcd")
+	sm.pool("test")
+
+	req, _ := http.NewRequest("GET", "http://localhost:9999/metrics", nil)
+	w := httptest.NewRecorder()
+	ap.Handler().ServeHTTP(w, req)
+	for _, line := range []string{
+		`manbearpig_tokens_sent_total{provider="test",app="app"} 3`,
+		`manbearpig_tokens_succeeded_total{provider="test",app="app"} 1`,
+		`manbearpig_tokens_failed_total{provider="test",app="app"} 2`,
+		`manbearpig_push_errors_total{provider="test",reason="MessageTooBig"} 1`,
+		`manbearpig_push_errors_total{provider="test",reason="Other"} 1`,
+		`manbearpig_push_duration_seconds_count{provider="test"} 1`,
+		`manbearpig_queue_depth{provider="test"} 0`,
+		`manbearpig_running 0`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("Missing %s in\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -1,8 +1,9 @@
 package manbearpig
 
 import (
+	"crypto/rand"
 	"encoding/json"
-	"os/exec"
+	"fmt"
 	"time"
 )
 
@@ -17,10 +18,39 @@ type Notification struct {
 	Payload      map[string]interface{} `json:"payload"`       // data sent to service.
 	Expiry       uint32                 `json:"expiry"`        // seconds
 	ExtraData    map[string]interface{} `json:"extra_data"`    // optional data for processing
-	Guid         string
-	CreatedAt    time.Time
-	Status       *PushStatus
-	Retries      int
+	Topic        string                 `json:"topic"`         // apns2 bundle id, optional with certificates
+	Environment  string                 `json:"environment"`   // apns/apns2 sandbox or production, optional
+	Priority     int                    `json:"priority"`      // apns/apns2 10 immediately or 5 to save power, optional
+	CollapseKey  string                 `json:"collapse_key"`  // notifications replacing each other, optional
+	CallbackURL  string                 `json:"callback_url"`  // optional url the final report is posted to
+	Guid         string                 `json:"guid"`
+	CreatedAt    time.Time              `json:"created_at"`
+	Status       *PushStatus            `json:"-"`
+	Retries      int                    `json:"retries"`
+	// Optional time to send at instead of straight away.
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// Optional wall clock time, like 2006-01-02T09:00, to send at in
+	// the time zone of each device token instead of straight away.
+	LocalSendTime string `json:"local_send_time,omitempty"`
+	// IANA time zone of the device tokens for LocalSendTime, UTC if
+	// empty, TimeZones overrides it per token.
+	TimeZone  string            `json:"time_zone,omitempty"`
+	TimeZones map[string]string `json:"time_zones,omitempty"`
+	// Why the job was given up on before being sent to every device.
+	AbandonReason string `json:"-"`
+	// Outcome of every send so far, kept for dead letters.
+	Attempts []*Attempt `json:"attempts,omitempty"`
+	// Guid of the job this one resends some tokens of.
+	ParentID string `json:"parent_id,omitempty"`
+	// The job itself, gone after a restart.
+	parent *Notification
+	// Derived jobs not finished yet and those of them still waiting
+	// for their send time, guarded by ServiceManager.derived.
+	pending int
+	waiting int
+	// Tokens of the derived jobs still waiting for their send time,
+	// all the Queue keeps of the job until they are sent.
+	unsent []string
 }
 
 // Bytes JSON encodes the Payload field of Notification.
@@ -30,16 +60,43 @@ func (n *Notification) Bytes() ([]byte, error) {
 
 // Read job information into self.
 func (n *Notification) Init() error {
-	// Generate a unique id for the push.
-	// This may be a bottleneck for high volumes.
-	out, err := exec.Command("uuidgen").Output()
+	// Generate a unique id for the push, a random (version 4) uuid.
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
 	if err != nil {
 		return err
 	}
-	n.Guid = string(out)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	n.Guid = fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 
 	// created_at
 	n.CreatedAt = time.Now().UTC()
 	n.Status = &PushStatus{}
+
+	// Only persisted by the Queue, not for clients to set.
+	n.Retries = 0
+	n.AbandonReason = ""
+	n.Attempts = nil
+	n.ParentID = ""
+	n.parent = nil
 	return nil
 }
+
+// Derive returns a job of its own sending n again to only tokens,
+// whose results are folded into those of n. It keeps the creation
+// time so the age of n limits its retries.
+func (n *Notification) Derive(tokens []string) (*Notification, error) {
+	d := *n
+	err := d.Init()
+	if err != nil {
+		return nil, err
+	}
+	d.DeviceTokens = tokens
+	d.CreatedAt = n.CreatedAt
+	d.Retries = n.Retries
+	d.ParentID = n.Guid
+	d.parent = n
+	d.pending, d.waiting, d.unsent = 0, 0, nil
+	return &d, nil
+}
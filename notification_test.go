@@ -11,3 +11,16 @@ func TestNotificationBytes(t *testing.T) {
 		t.Fatalf("Unmarshal notification payload %+v", err)
 	}
 }
+
+func TestNotificationInit(t *testing.T) {
+	n := &Notification{}
+	err := n.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &Notification{}
+	other.Init()
+	if len(n.Guid) != 36 || n.Guid == other.Guid {
+		t.Fatalf("Guids should be unique uuids %s %s", n.Guid, other.Guid)
+	}
+}
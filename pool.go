@@ -0,0 +1,138 @@
+package manbearpig
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// DefaultWorkers is how many jobs are sent at once per provider.
+	DefaultWorkers int = 10
+	// DefaultQueueSize is how many jobs may wait for a worker per
+	// provider before new ones are rejected.
+	DefaultQueueSize int = 1000
+)
+
+// ErrQueueFull is returned when a provider has no room for more jobs.
+var ErrQueueFull = fmt.Errorf("QueueFull")
+
+// ErrShuttingDown is returned for new jobs once shutdown has started.
+var ErrShuttingDown = fmt.Errorf("ShuttingDown")
+
+// PoolConfig sizes the worker pool of a provider.
+type PoolConfig struct {
+	Workers   int // goroutines sending jobs
+	QueueSize int // jobs waiting for a worker
+}
+
+// workerPool runs a fixed number of workers reading from a bounded
+// intake. New jobs must reserve room first so the api can turn them
+// away, jobs that were already accepted (retries, replays) may block.
+type workerPool struct {
+	jobs    chan *QueuedJob
+	stop    chan struct{}
+	size    int
+	waiting int // reserved or queued jobs not yet picked up by a worker
+	busy    int // workers sending a job
+	mu      sync.Mutex
+}
+
+func newWorkerPool(cfg PoolConfig, work func(*QueuedJob)) *workerPool {
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+
+	p := &workerPool{
+		jobs: make(chan *QueuedJob, cfg.QueueSize),
+		stop: make(chan struct{}),
+		size: cfg.QueueSize,
+	}
+	for x := 0; x < cfg.Workers; x++ {
+		go func() {
+			for {
+				select {
+				case qj := <-p.jobs:
+					p.mu.Lock()
+					p.waiting--
+					p.busy++
+					p.mu.Unlock()
+
+					work(qj)
+
+					p.mu.Lock()
+					p.busy--
+					p.mu.Unlock()
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// reserve makes room for n new jobs or returns ErrQueueFull.
+func (p *workerPool) reserve(n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.waiting+n > p.size {
+		return ErrQueueFull
+	}
+	p.waiting += n
+	return nil
+}
+
+// release gives back reserved room.
+func (p *workerPool) release(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waiting -= n
+}
+
+// put hands a reserved job to the workers.
+func (p *workerPool) put(qj *QueuedJob) {
+	p.jobs <- qj
+}
+
+// force hands an already accepted job to the workers without a
+// reservation, blocking until there is room. Once the pool is
+// stopped the job is left where it is, i.e. in the Queue.
+func (p *workerPool) force(qj *QueuedJob) {
+	p.mu.Lock()
+	p.waiting++
+	p.mu.Unlock()
+	select {
+	case p.jobs <- qj:
+	case <-p.stop:
+		p.release(1)
+	}
+}
+
+// idle reports whether there is nothing waiting or being sent.
+func (p *workerPool) idle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waiting == 0 && p.busy == 0
+}
+
+// Busy is the number of workers sending a job.
+func (p *workerPool) Busy() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.busy
+}
+
+// close stops the workers, anything still waiting is not sent.
+func (p *workerPool) close() {
+	close(p.stop)
+}
+
+// Depth is the number of jobs waiting for a worker.
+func (p *workerPool) Depth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waiting
+}
@@ -28,6 +28,23 @@ type PushStatus struct {
 	Auth string
 }
 
+// retryErrors are the errors Work sends the job again for.
+var retryErrors = map[string]bool{
+	"InternalServerError": true,
+	"ServiceUnavailable":  true,
+	"Unavailable":         true,
+	"InvalidResponse":     true,
+	"UnknownError":        true,
+	"TooManyRequests":     true,
+	"Shutdown":            true,
+	"QUOTA_EXCEEDED":      true,
+	"UNAVAILABLE":         true,
+	"INTERNAL":            true,
+	"Processing Errors":   true,
+	"Unknown":             true,
+	"ClientNotConnected":  true,
+}
+
 func NewPushStatus(notification *Notification) *PushStatus {
 	return &PushStatus{
 		Retry:        false,
@@ -47,6 +64,91 @@ func (p *PushStatus) Ok() bool {
 	return false
 }
 
+// Retryable determines if Work will send the job again.
+func (p *PushStatus) Retryable() bool {
+	for _, err := range p.Errors {
+		if retryErrors[err.Error()] {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTokens returns the tokens of a job that failed with an error
+// worth sending again for, every token if the whole job did.
+func (p *PushStatus) retryTokens(job *Notification) []string {
+	if err, ok := p.Errors[""]; ok && retryErrors[err.Error()] {
+		return job.DeviceTokens
+	}
+	var tokens []string
+	for _, devToken := range job.DeviceTokens {
+		if err, ok := p.Errors[devToken]; ok && retryErrors[err.Error()] {
+			tokens = append(tokens, devToken)
+		}
+	}
+	return tokens
+}
+
+// merge returns a copy of p with the outcome of sending again to
+// tokens in place of their earlier errors. Errors for the whole of
+// the resent job are kept for each of its tokens.
+func (p *PushStatus) merge(tokens []string, ps *PushStatus) *PushStatus {
+	merged := NewPushStatus(p.Notification)
+	merged.Auth = p.Auth
+	merged.Successes = p.Successes + ps.Successes
+	for devToken, err := range p.Errors {
+		merged.Errors[devToken] = err
+	}
+	for devToken, update := range p.Updates {
+		merged.Updates[devToken] = update
+	}
+	if err, ok := merged.Errors[""]; ok && retryErrors[err.Error()] {
+		delete(merged.Errors, "")
+	}
+	for _, devToken := range tokens {
+		delete(merged.Errors, devToken)
+	}
+	for devToken, err := range ps.Errors {
+		if devToken != "" {
+			merged.Errors[devToken] = err
+			continue
+		}
+		for _, t := range tokens {
+			merged.Errors[t] = err
+		}
+	}
+	for devToken, update := range ps.Updates {
+		merged.Updates[devToken] = update
+	}
+	return merged
+}
+
+// attempt returns the outcome of the push for the job's history.
+func (p *PushStatus) attempt() *Attempt {
+	a := &Attempt{Time: time.Now().UTC(), Successes: p.Successes}
+	if len(p.Errors) > 0 {
+		a.Errors = map[string]string{}
+		for devToken, err := range p.Errors {
+			a.Errors[devToken] = err.Error()
+		}
+	}
+	return a
+}
+
+// AuthRejected reports whether nothing was sent because the
+// provider refused the credentials.
+func (p *PushStatus) AuthRejected() bool {
+	if p.Successes > 0 || len(p.Errors) == 0 {
+		return false
+	}
+	for _, err := range p.Errors {
+		if feedbackErrors[err.Error()] != AuthRejected {
+			return false
+		}
+	}
+	return true
+}
+
 // Convert the status to a json encoded string of either ok, or
 // combined error/update messages.
 // After attempting a push serialize any errors/updates.
@@ -86,44 +188,82 @@ func (p *PushStatus) String() string {
 	return string(b)
 }
 
-// Reenqueue jobs after a set delay.
+// ReSend schedules the job to be sent again after a backoff no
+// shorter than Delay, or abandons it once its app's RetryPolicy is
+// used up.
 func (p *PushStatus) ReSend(job *Notification) {
-	job.Retries++
-	if job.Retries > 10 {
-		// Give up spaminator.
-		return
-	}
-
-	switch p.Delay {
-	case 0:
-		time.Sleep(time.Duration(job.Retries) * time.Second)
-	default:
-		time.Sleep(time.Duration(p.Delay) * time.Second)
-	}
-
-	if !SMGlobal.Quitting {
-		go SMGlobal.Work(job, p.Auth)
-	}
+	SMGlobal.retry(job, p.Auth, time.Duration(p.Delay)*time.Second)
 }
 
-// Create a new job for a single device.
-func (p *PushStatus) NewJob(job *Notification, auth string) {
+// NewJob sends a job again to only tokens, so devices that already
+// got it don't get it twice. A derived job is created the first time
+// so the job keeps the results of the other tokens, after that the
+// derived job is narrowed down. The job is only acked once the
+// tokens are in the Queue, nothing is resent if that fails.
+func (p *PushStatus) NewJob(job *Notification, tokens []string) error {
 	newJob := job
+	if job.parent == nil {
+		var err error
+		newJob, err = job.Derive(tokens)
+		if err != nil {
+			return err
+		}
+	} else {
+		newJob.DeviceTokens = tokens
+	}
+	err := SMGlobal.Queue.Put(&QueuedJob{newJob, p.Auth})
+	if err != nil {
+		return err
+	}
+	if newJob != job {
+		SMGlobal.derived.Lock()
+		job.pending++
+		SMGlobal.derived.Unlock()
+		SMGlobal.ack(job)
+	}
+	SMGlobal.Statuses.Set(newJob, JobRetrying)
 	p.ReSend(newJob)
+	return nil
 }
 
-// ProcessErrors iterates return responses and resends jobs
-// or removes tokens depending on the return.
+// ProcessErrors iterates return responses and reports tokens to
+// remove depending on the return, Work resends the jobs.
 func (p *PushStatus) ProcessErrors(job *Notification) {
+	authRejected := false
 	for devToken, err := range p.Errors {
 		log.Printf("%s %v", err, devToken)
 
+		// Let the owner of the token db know.
+		eventType, ok := feedbackErrors[err.Error()]
+		switch {
+		case ok && eventType == AuthRejected:
+			// Once per job is enough.
+			if !authRejected {
+				authRejected = true
+				SMGlobal.feedback(&FeedbackEvent{
+					Type:     eventType,
+					AppName:  job.AppName,
+					Provider: job.Provider,
+					Reason:   err.Error(),
+					JobID:    job.Guid,
+				})
+			}
+		case ok && devToken != "":
+			SMGlobal.feedback(&FeedbackEvent{
+				Type:     eventType,
+				AppName:  job.AppName,
+				Provider: job.Provider,
+				Token:    devToken,
+				Reason:   err.Error(),
+				JobID:    job.Guid,
+			})
+		}
+
 		switch err.Error() {
 		case "NoRegistrationIDs":
 			// No-op
 		case "TooManyRegistrationIDs":
-			// TODO either handle client side or split up here and resend job.
-			// For reference
+			// GCM.Push sends large jobs in batches, not expected.
 		case "MissingRegistration":
 			// No-op
 		case "InvalidRegistration":
@@ -159,17 +299,44 @@ func (p *PushStatus) ProcessErrors(job *Notification) {
 			// the value passed in the request.
 			// No-op
 		case "InternalServerError":
-			p.NewJob(job, devToken)
+			// Sent again by Work.
 		case "ServiceUnavailable":
-			p.NewJob(job, devToken)
+			// Sent again by Work.
 		case "Unavailable":
-			p.NewJob(job, devToken)
+			// Sent again by Work.
 		case "Unauthorized":
 			// Remove auth tokens.
+		case "UNREGISTERED":
+			// FCM token is no longer valid.
+			// Remove from db.
+		case "INVALID_ARGUMENT":
+			// FCM message fields are malformed, a malformed token
+			// is InvalidRegistration.
+			// No-op
+		case "SENDER_ID_MISMATCH", "THIRD_PARTY_AUTH_ERROR", "InvalidServiceAccount":
+			// Remove auth tokens.
+		case "QUOTA_EXCEEDED", "UNAVAILABLE", "INTERNAL":
+			// Sent again by Work.
+		case "InvalidProviderToken", "MissingProviderToken":
+			// APNS2 token auth key, key id or team id are wrong.
+			// Remove auth tokens.
 		case "InvalidResponse":
-			p.NewJob(job, devToken)
+			// Sent again by Work.
 		case "UnknownError":
-			p.NewJob(job, devToken)
+			// Sent again by Work.
+		case "BadDeviceToken":
+			// APNS2 token is malformed or for the other environment.
+			// Remove from db.
+		case "Unregistered":
+			// APNS2 device token is no longer active for the topic.
+			// Remove from db.
+		case "TooManyRequests":
+			// Sent again by Work.
+		case "Shutdown":
+			// Sent again by Work.
+		case "Processing Errors", "Unknown", "ClientNotConnected":
+			// APNS error responses and connections that kept failing.
+			// Sent again by Work.
 		default:
 		}
 	}
@@ -179,5 +346,16 @@ func (p *PushStatus) ProcessErrors(job *Notification) {
 func (p *PushStatus) ProcessUpdates() {
 	for devToken, updateId := range p.Updates {
 		log.Printf("Updating tokens %s %s", devToken, updateId)
+		event := &FeedbackEvent{
+			Type:     TokenCanonicalized,
+			Token:    devToken,
+			NewToken: updateId,
+		}
+		if p.Notification != nil {
+			event.AppName = p.Notification.AppName
+			event.Provider = p.Notification.Provider
+			event.JobID = p.Notification.Guid
+		}
+		SMGlobal.feedback(event)
 	}
 }
@@ -2,7 +2,11 @@ package manbearpig
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPushStatusString(t *testing.T) {
@@ -37,6 +41,108 @@ func TestPushStatusOk(t *testing.T) {
 func BenchmarkPushStatusString(b *testing.B) {
 	ps := NewPushStatus(nil)
 	for i := 0; i < b.N; i++ {
-		ps.String()
+		_ = ps.String()
+	}
+}
+
+// flakyService fails tokens in unavailable the first time they are
+// sent and tokens in invalid every time.
+type flakyService struct {
+	pushed      chan []string
+	unavailable map[string]bool
+	invalid     map[string]bool
+	mu          *sync.Mutex
+}
+
+func (s flakyService) Push(n *Notification, auth string) *PushStatus {
+	s.pushed <- n.DeviceTokens
+	ps := NewPushStatus(n)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range n.DeviceTokens {
+		switch {
+		case s.unavailable[token]:
+			delete(s.unavailable, token)
+			ps.Errors[token] = fmt.Errorf("Unavailable")
+		case s.invalid[token]:
+			ps.Errors[token] = fmt.Errorf("NotRegistered")
+		default:
+			ps.Successes++
+		}
+	}
+	return ps
+}
+
+func TestPushStatusPartialRetry(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	pushed := make(chan []string, 3)
+	sm.Services["test"] = flakyService{
+		pushed:      pushed,
+		unavailable: map[string]bool{"b": true, "c": true},
+		invalid:     map[string]bool{"d": true},
+		mu:          &sync.Mutex{},
+	}
+
+	job := &Notification{Provider: "test", DeviceTokens: []string{"a", "b", "c", "d"}}
+	err = sm.Enqueue([]*Notification{job}, "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-pushed
+	select {
+	case tokens := <-pushed:
+		sort.Strings(tokens)
+		if strings.Join(tokens, ",") != "b,c" {
+			t.Fatalf("Expected only the unavailable tokens resent got %v", tokens)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the retry")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		js, _ := sm.Statuses.Get(job.Guid)
+		if js.Finished() {
+			if js.State != JobFailed || string(js.Status) != `{"errors":{"d":"NotRegistered"}}` || js.Retries != 1 {
+				t.Fatalf("Expected the parent to fail for d only got %+v %s", js, js.Status)
+			}
+			if job.Status.Successes != 3 {
+				t.Fatalf("Expected 3 successes got %d", job.Status.Successes)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Parent never finished %+v", js)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending, _ := sm.Queue.Pending(); len(pending) != 0 {
+		t.Fatalf("Expected nothing left in the queue got %d", len(pending))
+	}
+}
+
+func TestPushStatusRetryQueuedFirst(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.Services["test"] = flakyService{
+		pushed:      make(chan []string, 3),
+		unavailable: map[string]bool{"b": true},
+		mu:          &sync.Mutex{},
+	}
+
+	job := &Notification{Provider: "test", DeviceTokens: []string{"a", "b"}}
+	job.Init()
+	sm.Queue.Put(&QueuedJob{job, "abcd"})
+	sm.Work(job, "abcd")
+
+	// The tokens to resend are in the Queue before Work returns.
+	pending, _ := sm.Queue.Pending()
+	if len(pending) != 1 || pending[0].Job.ParentID != job.Guid || strings.Join(pending[0].Job.DeviceTokens, ",") != "b" {
+		t.Fatalf("Expected only the derived job for b queued got %+v", pending)
 	}
 }
@@ -0,0 +1,296 @@
+package manbearpig
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	// QueueCompactThreshold is how many acknowledged jobs a FileQueue
+	// log can hold before it is rewritten with only the pending ones.
+	QueueCompactThreshold int = 1000
+)
+
+// QueuedJob is a job accepted by the api and the auth it is sent with.
+type QueuedJob struct {
+	Job  *Notification `json:"job"`
+	Auth string        `json:"auth"`
+}
+
+// Queue holds accepted jobs until they reach a terminal PushStatus,
+// so that anything in flight can be replayed after a restart.
+type Queue interface {
+	// Put stores a job, the job must already have a Guid.
+	// Putting a Guid that is already pending replaces it.
+	Put(*QueuedJob) error
+	// Ack removes a finished job.
+	Ack(guid string) error
+	// Pending returns every job that was Put but not Ack'd, oldest first.
+	Pending() ([]*QueuedJob, error)
+	Close() error
+}
+
+// MemoryQueue is a Queue that does not survive restarts.
+type MemoryQueue struct {
+	jobs map[string]*QueuedJob
+	mu   sync.Mutex
+}
+
+// NewMemoryQueue [...]
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{jobs: map[string]*QueuedJob{}}
+}
+
+// Put [...]
+func (q *MemoryQueue) Put(qj *QueuedJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs[qj.Job.Guid] = qj
+	return nil
+}
+
+// Ack [...]
+func (q *MemoryQueue) Ack(guid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.jobs, guid)
+	return nil
+}
+
+// Pending [...]
+func (q *MemoryQueue) Pending() ([]*QueuedJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return sortedJobs(q.jobs), nil
+}
+
+// Close [...]
+func (q *MemoryQueue) Close() error {
+	return nil
+}
+
+// queueRecord is a single line in the FileQueue log.
+type queueRecord struct {
+	Op     string        `json:"op"` // put/ack
+	Guid   string        `json:"guid"`
+	Job    *Notification `json:"job,omitempty"`
+	Auth   string        `json:"auth,omitempty"`
+	Sealed string        `json:"sealed,omitempty"` // Auth encrypted with the master key
+}
+
+// FileQueue is a Queue backed by an append only log of JSON records
+// on disk. Puts are synced before returning so an accepted job is not
+// lost if the process dies. The auth of a job is stored with it,
+// encrypted with the master key if there is one.
+type FileQueue struct {
+	path string
+	key  []byte
+	file *os.File
+	jobs map[string][]byte // pending put records by guid
+	acks int
+	mu   sync.Mutex
+}
+
+// NewFileQueue opens the log at path, creating it if needed, and
+// replays it to find the pending jobs. Auths are encrypted with key,
+// or stored in plaintext if it is nil.
+func NewFileQueue(path string, key []byte) (*FileQueue, error) {
+	q := &FileQueue{path: path, key: key, jobs: map[string][]byte{}}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is a write interrupted by a crash.
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		var rec queueRecord
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			log.Printf("Queue %s: skipping corrupt record at %d: %s", path, offset, err)
+			break
+		}
+		offset += int64(len(line))
+		q.apply(&rec, line)
+	}
+
+	// Drop anything after the last good record and append from there.
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	q.file = f
+	return q, nil
+}
+
+// apply updates the pending jobs with a record.
+func (q *FileQueue) apply(rec *queueRecord, line []byte) {
+	switch rec.Op {
+	case "put":
+		if rec.Job != nil {
+			q.jobs[rec.Guid] = line
+		}
+	case "ack":
+		if _, ok := q.jobs[rec.Guid]; ok {
+			delete(q.jobs, rec.Guid)
+			q.acks++
+		}
+	}
+}
+
+// write appends a record to the log.
+func (q *FileQueue) write(rec *queueRecord, sync bool) ([]byte, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, '\n')
+	_, err = q.file.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	if sync {
+		return b, q.file.Sync()
+	}
+	return b, nil
+}
+
+// Put [...]
+func (q *FileQueue) Put(qj *QueuedJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	rec := &queueRecord{Op: "put", Guid: qj.Job.Guid, Job: qj.Job, Auth: qj.Auth}
+	if q.key != nil && rec.Auth != "" {
+		var err error
+		rec.Sealed, err = seal(q.key, []byte(rec.Auth))
+		if err != nil {
+			return err
+		}
+		rec.Auth = ""
+	}
+	line, err := q.write(rec, true)
+	if err != nil {
+		return err
+	}
+	q.apply(rec, line)
+	return nil
+}
+
+// Ack [...]
+func (q *FileQueue) Ack(guid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.jobs[guid]; !ok {
+		return nil
+	}
+	// A lost ack only means the job is sent again, no need to sync.
+	rec := &queueRecord{Op: "ack", Guid: guid}
+	line, err := q.write(rec, false)
+	if err != nil {
+		return err
+	}
+	q.apply(rec, line)
+
+	if q.acks >= QueueCompactThreshold && q.acks > len(q.jobs) {
+		return q.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log with only the pending jobs.
+func (q *FileQueue) compact() error {
+	tmpPath := q.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, line := range q.jobs {
+		w.Write(line)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, q.path)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	q.file.Close()
+	q.file = tmp
+	q.acks = 0
+	return nil
+}
+
+// Pending [...]
+func (q *FileQueue) Pending() ([]*QueuedJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := map[string]*QueuedJob{}
+	for guid, line := range q.jobs {
+		var rec queueRecord
+		err := json.Unmarshal(line, &rec)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Sealed != "" {
+			if q.key == nil {
+				return nil, fmt.Errorf("MissingMasterKey")
+			}
+			auth, err := unseal(q.key, rec.Sealed)
+			if err != nil {
+				return nil, err
+			}
+			rec.Auth = string(auth)
+		}
+		jobs[guid] = &QueuedJob{rec.Job, rec.Auth}
+	}
+	return sortedJobs(jobs), nil
+}
+
+// Close [...]
+func (q *FileQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
+
+// sortedJobs returns the jobs ordered by creation time.
+func sortedJobs(jobs map[string]*QueuedJob) []*QueuedJob {
+	sorted := make([]*QueuedJob, 0, len(jobs))
+	for _, qj := range jobs {
+		sorted = append(sorted, qj)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Job.CreatedAt.Before(sorted[j].Job.CreatedAt)
+	})
+	return sorted
+}
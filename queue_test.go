@@ -0,0 +1,130 @@
+package manbearpig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newQueuedJob(t *testing.T) *QueuedJob {
+	n := &Notification{AppName: "test", Provider: "gcm", DeviceTokens: []string{"a"}}
+	err := n.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &QueuedJob{n, "abcd"}
+}
+
+func TestFileQueueReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q, err := NewFileQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := newQueuedJob(t)
+	inflight := newQueuedJob(t)
+	q.Put(done)
+	q.Put(inflight)
+	q.Ack(done.Job.Guid)
+	q.Close()
+
+	// Simulate a crash half way through writing a record.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write([]byte(`{"op":"put","guid":"partial","job":{`))
+	f.Close()
+
+	q, err = NewFileQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	pending, err := q.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Job.Guid != inflight.Job.Guid || pending[0].Auth != "abcd" {
+		t.Fatalf("Expected only the in flight job %+v", pending)
+	}
+
+	// The partial record is dropped and new records still parse.
+	q.Put(newQueuedJob(t))
+	q.Close()
+	q, _ = NewFileQueue(path, nil)
+	pending, _ = q.Pending()
+	if len(pending) != 2 {
+		t.Fatalf("Expected 2 pending jobs %+v", pending)
+	}
+}
+
+func TestFileQueueCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q, err := NewFileQueue(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	keep := newQueuedJob(t)
+	q.Put(keep)
+	for i := 0; i < QueueCompactThreshold; i++ {
+		qj := newQueuedJob(t)
+		q.Put(qj)
+		q.Ack(qj.Job.Guid)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	q2, _ := NewFileQueue(path, nil)
+	pending, _ := q2.Pending()
+	q2.Close()
+	if len(pending) != 1 || pending[0].Job.Guid != keep.Job.Guid {
+		t.Fatalf("Expected only the kept job after compaction %+v", pending)
+	}
+	if len(b) > 2048 {
+		t.Fatalf("Log was not compacted, %d bytes", len(b))
+	}
+}
+
+func TestFileQueueSealed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	key := bytes.Repeat([]byte{1}, 32)
+	q, err := NewFileQueue(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Put(newQueuedJob(t))
+	q.Close()
+
+	b, _ := ioutil.ReadFile(path)
+	if bytes.Contains(b, []byte("abcd")) {
+		t.Fatalf("Expected the auth encrypted got %s", b)
+	}
+	q, _ = NewFileQueue(path, key)
+	pending, err := q.Pending()
+	q.Close()
+	if err != nil || len(pending) != 1 || pending[0].Auth != "abcd" {
+		t.Fatalf("Expected the auth decrypted got %+v %v", pending, err)
+	}
+	q, _ = NewFileQueue(path, nil)
+	defer q.Close()
+	if _, err = q.Pending(); err == nil {
+		t.Fatal("Expected MissingMasterKey")
+	}
+}
+
+func TestMemoryQueue(t *testing.T) {
+	q := NewMemoryQueue()
+	qj := newQueuedJob(t)
+	q.Put(qj)
+	pending, _ := q.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("%+v", pending)
+	}
+	q.Ack(qj.Job.Guid)
+	pending, _ = q.Pending()
+	if len(pending) != 0 {
+		t.Fatalf("%+v", pending)
+	}
+}
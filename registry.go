@@ -0,0 +1,519 @@
+package manbearpig
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// CredentialGrace is how long a rotated out credential stays
+	// active when no grace period is given.
+	CredentialGrace time.Duration = 24 * time.Hour
+	// CertExpiryWarning is how long before a certificate expires
+	// warnings are logged.
+	CertExpiryWarning time.Duration = 30 * 24 * time.Hour
+)
+
+// Credential is what an app authenticates with for one provider.
+type Credential struct {
+	// Certificate and key PEM, api key, service account JSON or
+	// token auth JSON depending on the provider.
+	Auth        string            `json:"auth,omitempty"`
+	Sealed      string            `json:"sealed,omitempty"`      // Auth encrypted with the master key, on disk only
+	Environment string            `json:"environment,omitempty"` // apns sandbox/production
+	Settings    map[string]string `json:"settings,omitempty"`    // e.g. apns2 topic
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`  // NotAfter of the certificate in Auth
+	RetireAt    *time.Time        `json:"retire_at,omitempty"`   // end of the grace period once rotated out
+	// Credentials rotated out that are still tried when this one is
+	// rejected, newest first.
+	Previous []*Credential `json:"previous,omitempty"`
+}
+
+// Active reports whether a credential may still be used.
+func (c *Credential) Active(now time.Time) bool {
+	return c.RetireAt == nil || now.Before(*c.RetireAt)
+}
+
+func (c *Credential) redacted() *Credential {
+	cp := &Credential{
+		Environment: c.Environment,
+		Settings:    c.Settings,
+		ExpiresAt:   c.ExpiresAt,
+		RetireAt:    c.RetireAt,
+	}
+	for _, prev := range c.Previous {
+		cp.Previous = append(cp.Previous, prev.redacted())
+	}
+	return cp
+}
+
+// App is an application registered with its provider credentials
+// so that jobs only need to reference it by name.
+type App struct {
+	Name        string                 `json:"name"`
+	Credentials map[string]*Credential `json:"credentials"` // by provider
+	CallbackURL string                 `json:"callback_url,omitempty"`
+	Retry       *RetryPolicy           `json:"retry,omitempty"` // defaults if nil
+}
+
+// Redacted returns a copy of the app without any secrets.
+func (app *App) Redacted() *App {
+	cp := &App{Name: app.Name, CallbackURL: app.CallbackURL, Retry: app.Retry, Credentials: map[string]*Credential{}}
+	for provider, cred := range app.Credentials {
+		cp.Credentials[provider] = cred.redacted()
+	}
+	return cp
+}
+
+// registryFile is the layout of the registry config file.
+type registryFile struct {
+	Apps []*App `json:"apps"`
+}
+
+// Registry holds the registered apps. When loaded from a file,
+// changes made through the admin api are written back to it, with
+// the credentials encrypted if there is a master key.
+type Registry struct {
+	path string
+	key  []byte
+	apps map[string]*App
+	// Credentials taken out by Put and Delete, to be retired.
+	dropped []droppedCredential
+	mu      sync.RWMutex
+}
+
+// droppedCredential is a credential an app no longer has.
+type droppedCredential struct {
+	app, provider, auth string
+}
+
+// NewRegistry returns an empty in memory Registry.
+func NewRegistry() *Registry {
+	return &Registry{apps: map[string]*App{}}
+}
+
+// LoadRegistry reads the apps from the JSON file at path, decrypting
+// the credentials with key. Plaintext credentials found in the file
+// are encrypted straight away when there is a key.
+//
+//	{"apps": [{"name": "fart app", "credentials": {"gcm": {"auth": "key"}}}]}
+func LoadRegistry(path string, key []byte) (*Registry, error) {
+	r := NewRegistry()
+	r.path = path
+	r.key = key
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rf registryFile
+	err = json.Unmarshal(b, &rf)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := false
+	for _, app := range rf.Apps {
+		for _, cred := range app.Credentials {
+			p, err := r.unseal(cred)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", app.Name, err)
+			}
+			plaintext = plaintext || p
+		}
+		err = validateApp(app)
+		if err != nil {
+			return nil, err
+		}
+		r.apps[app.Name] = app
+		warnExpiring(app, time.Now())
+	}
+
+	if plaintext && key != nil {
+		log.Printf("Encrypting plaintext credentials in %s", path)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		err = r.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// unseal decrypts a credential read from disk and the ones it
+// replaced, plaintext is true if any were not encrypted.
+func (r *Registry) unseal(cred *Credential) (plaintext bool, err error) {
+	if cred == nil {
+		return false, nil
+	}
+	if cred.Sealed != "" {
+		if r.key == nil {
+			return false, fmt.Errorf("MissingMasterKey")
+		}
+		auth, err := unseal(r.key, cred.Sealed)
+		if err != nil {
+			return false, err
+		}
+		cred.Auth = string(auth)
+		cred.Sealed = ""
+	} else if cred.Auth != "" {
+		plaintext = true
+	}
+	for _, prev := range cred.Previous {
+		p, err := r.unseal(prev)
+		if err != nil {
+			return false, err
+		}
+		plaintext = plaintext || p
+	}
+	return plaintext, nil
+}
+
+// sealed returns a copy of a credential as it is written to disk.
+func (r *Registry) sealed(cred *Credential) (*Credential, error) {
+	cp := *cred
+	cp.Previous = nil
+	if r.key != nil && cp.Auth != "" {
+		var err error
+		cp.Sealed, err = seal(r.key, []byte(cp.Auth))
+		if err != nil {
+			return nil, err
+		}
+		cp.Auth = ""
+	}
+	for _, prev := range cred.Previous {
+		sp, err := r.sealed(prev)
+		if err != nil {
+			return nil, err
+		}
+		cp.Previous = append(cp.Previous, sp)
+	}
+	return &cp, nil
+}
+
+func validateApp(app *App) error {
+	if app.Name == "" {
+		return fmt.Errorf("MissingAppName")
+	}
+	if app.Credentials == nil {
+		app.Credentials = map[string]*Credential{}
+	}
+	if app.Retry != nil {
+		err := app.Retry.validate()
+		if err != nil {
+			return err
+		}
+	}
+	for provider, cred := range app.Credentials {
+		if cred == nil {
+			return fmt.Errorf("MissingCredential: %s", provider)
+		}
+		validateCredential(cred)
+	}
+	return nil
+}
+
+// validateCredential fills in what is derived from the auth.
+func validateCredential(cred *Credential) {
+	cred.Sealed = ""
+	cred.ExpiresAt = nil
+	if notAfter, ok := certNotAfter(cred.Auth); ok {
+		cred.ExpiresAt = &notAfter
+	}
+	for _, prev := range cred.Previous {
+		validateCredential(prev)
+	}
+}
+
+// certNotAfter returns when the first certificate in a PEM auth
+// expires, ok is false if there is none.
+func certNotAfter(auth string) (notAfter time.Time, ok bool) {
+	rest := []byte(auth)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return time.Time{}, false
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return cert.NotAfter.UTC(), true
+	}
+}
+
+// warnExpiring logs the active certificates of an app that expire
+// within CertExpiryWarning of now.
+func warnExpiring(app *App, now time.Time) {
+	for provider, cred := range app.Credentials {
+		for _, c := range append([]*Credential{cred}, cred.Previous...) {
+			if c.ExpiresAt == nil || !c.Active(now) || c.ExpiresAt.Sub(now) > CertExpiryWarning {
+				continue
+			}
+			if c.ExpiresAt.Before(now) {
+				log.Printf("Certificate of %s for %s expired %s", app.Name, provider, c.ExpiresAt)
+			} else {
+				log.Printf("Certificate of %s for %s expires %s", app.Name, provider, c.ExpiresAt)
+			}
+		}
+	}
+}
+
+// save writes the apps back to the file the registry was loaded from.
+// It must be called with the lock held.
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	var rf registryFile
+	for _, app := range r.list() {
+		cp := &App{Name: app.Name, CallbackURL: app.CallbackURL, Retry: app.Retry, Credentials: map[string]*Credential{}}
+		for provider, cred := range app.Credentials {
+			sealed, err := r.sealed(cred)
+			if err != nil {
+				return err
+			}
+			cp.Credentials[provider] = sealed
+		}
+		rf.Apps = append(rf.Apps, cp)
+	}
+	b, err := json.MarshalIndent(rf, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpPath := r.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, r.path)
+}
+
+// Put adds or replaces an app.
+func (r *Registry) Put(app *App) error {
+	err := validateApp(app)
+	if err != nil {
+		return err
+	}
+	warnExpiring(app, time.Now())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.apps[app.Name]; ok {
+		r.drop(old, app)
+	}
+	r.apps[app.Name] = app
+	return r.save()
+}
+
+// drop keeps the credentials of old, current or rotated out, that app
+// does not have to be retired. app is nil when old is deleted. It must
+// be called with the lock held.
+func (r *Registry) drop(old, app *App) {
+	for provider, cred := range old.Credentials {
+		kept := map[string]bool{}
+		if app != nil {
+			if c, ok := app.Credentials[provider]; ok {
+				for _, k := range append([]*Credential{c}, c.Previous...) {
+					kept[k.Auth] = true
+				}
+			}
+		}
+		for _, c := range append([]*Credential{cred}, cred.Previous...) {
+			if c.Auth != "" && !kept[c.Auth] {
+				r.dropped = append(r.dropped, droppedCredential{old.Name, provider, c.Auth})
+			}
+		}
+	}
+}
+
+// takeDropped returns the credentials dropped since it was last called.
+func (r *Registry) takeDropped() []droppedCredential {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dropped := r.dropped
+	r.dropped = nil
+	return dropped
+}
+
+// Rotate makes cred the credential of an app for a provider. The one
+// it replaces stays active for grace, so jobs are not rejected while
+// the new one is rolled out and connections made with it are not
+// dropped.
+func (r *Registry) Rotate(name, provider string, cred *Credential, grace time.Duration) (*App, error) {
+	validateCredential(cred)
+	now := time.Now().UTC()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	app, ok := r.apps[name]
+	if !ok {
+		return nil, fmt.Errorf("UnknownApp")
+	}
+
+	// Apps are never modified in place as they are read without the lock.
+	rotated := &App{Name: app.Name, CallbackURL: app.CallbackURL, Retry: app.Retry, Credentials: map[string]*Credential{}}
+	for p, c := range app.Credentials {
+		rotated.Credentials[p] = c
+	}
+	cred.Previous = nil
+	if old, ok := rotated.Credentials[provider]; ok {
+		retired := *old
+		retired.Previous = nil
+		if retired.RetireAt == nil || retired.RetireAt.After(now.Add(grace)) {
+			retireAt := now.Add(grace)
+			retired.RetireAt = &retireAt
+		}
+		for _, c := range append([]*Credential{&retired}, old.Previous...) {
+			if c.Active(now) {
+				cred.Previous = append(cred.Previous, c)
+			}
+		}
+	}
+	rotated.Credentials[provider] = cred
+	warnExpiring(rotated, now)
+
+	r.apps[name] = rotated
+	return rotated, r.save()
+}
+
+// Delete removes an app, ok is false if there was none.
+func (r *Registry) Delete(name string) (ok bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.apps[name]
+	if !ok {
+		return false, nil
+	}
+	r.drop(old, nil)
+	delete(r.apps, name)
+	return true, r.save()
+}
+
+// Get [...]
+func (r *Registry) Get(name string) (*App, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	app, ok := r.apps[name]
+	return app, ok
+}
+
+// List returns every app sorted by name.
+func (r *Registry) List() []*App {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.list()
+}
+
+func (r *Registry) list() []*App {
+	apps := make([]*App, 0, len(r.apps))
+	for _, app := range r.apps {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	return apps
+}
+
+// Credential returns the credential of an app for a provider.
+func (r *Registry) Credential(appName, provider string) (*Credential, bool) {
+	app, ok := r.Get(appName)
+	if !ok {
+		return nil, false
+	}
+	cred, ok := app.Credentials[provider]
+	return cred, ok
+}
+
+// Credentials returns the active credentials of an app for a
+// provider, the current one first.
+func (r *Registry) Credentials(appName, provider string) []*Credential {
+	cred, ok := r.Credential(appName, provider)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	creds := []*Credential{cred}
+	for _, prev := range cred.Previous {
+		if prev.Active(now) {
+			creds = append(creds, prev)
+		}
+	}
+	return creds
+}
+
+// retirer is implemented by services holding connections made with
+// a credential.
+type retirer interface {
+	Retire(appName, authKey string)
+}
+
+// RetireCredentials lets go of the connections made with credentials
+// rotated out whose grace period is over and with those taken out by
+// replacing or deleting their app.
+func (sm *ServiceManager) RetireCredentials(now time.Time) {
+	for _, d := range sm.Registry.takeDropped() {
+		if service, ok := sm.Services[d.provider].(retirer); ok {
+			service.Retire(d.app, d.auth)
+		}
+	}
+	for _, app := range sm.Registry.List() {
+		for provider, cred := range app.Credentials {
+			service, ok := sm.Services[provider].(retirer)
+			if !ok {
+				continue
+			}
+			for _, prev := range cred.Previous {
+				if !prev.Active(now) && prev.Auth != "" {
+					service.Retire(app.Name, prev.Auth)
+				}
+			}
+		}
+	}
+}
+
+// WatchRetiredCredentials calls RetireCredentials every interval
+// until Quit is closed.
+func (sm *ServiceManager) WatchRetiredCredentials(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			sm.RetireCredentials(now)
+		case <-sm.Quit:
+			return
+		}
+	}
+}
+
+// WatchCredentials logs certificates about to expire every interval
+// until quit is closed.
+func (r *Registry) WatchCredentials(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, app := range r.List() {
+				warnExpiring(app, now)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
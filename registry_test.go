@@ -0,0 +1,252 @@
+package manbearpig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "apps.json")
+
+	r, err := LoadRegistry(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{Name: "fart app", Credentials: map[string]*Credential{"gcm": {Auth: "abcd"}}}
+	if err = r.Put(app); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Put(&App{Name: "other app"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.Delete("other app"); !ok || err != nil {
+		t.Fatalf("Expected other app deleted got %v %v", ok, err)
+	}
+
+	r, err = LoadRegistry(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apps := r.List(); len(apps) != 1 {
+		t.Fatalf("Expected 1 app got %+v", apps)
+	}
+	cred, ok := r.Credential("fart app", "gcm")
+	if !ok || cred.Auth != "abcd" {
+		t.Fatalf("Expected gcm credential got %+v", cred)
+	}
+	if redacted := app.Redacted(); redacted.Credentials["gcm"].Auth != "" {
+		t.Fatalf("Expected no auth got %+v", redacted.Credentials["gcm"])
+	}
+}
+
+func TestServiceManagerResolve(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.Registry.Put(&App{
+		Name:        "fart app",
+		Credentials: map[string]*Credential{"apns2": {Auth: "abcd", Settings: map[string]string{"topic": "com.fart.app"}}},
+		CallbackURL: "http://example.com/report",
+	})
+
+	job := &Notification{AppName: "fart app", Provider: "apns2"}
+	auths, err := sm.resolve(job, "")
+	if err != nil || len(auths) != 1 || auths[0] != "abcd" {
+		t.Fatalf("Expected registered auth got %q %v", auths, err)
+	}
+	if job.Topic != "com.fart.app" || job.CallbackURL != "http://example.com/report" {
+		t.Fatalf("Expected app settings got %+v", job)
+	}
+
+	if auths, _ = sm.resolve(job, "efgh"); len(auths) != 1 || auths[0] != "efgh" {
+		t.Fatalf("Expected auth override got %q", auths)
+	}
+	_, err = sm.resolve(&Notification{AppName: "other app", Provider: "gcm"}, "")
+	if err == nil || err.Error() != "MissingCredentials" {
+		t.Fatalf("Expected MissingCredentials got %v", err)
+	}
+}
+
+func TestRegistrySealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "apps.json")
+	ioutil.WriteFile(path, []byte(`{"apps": [{"name": "fart app", "credentials": {"gcm": {"auth": "abcd"}}}]}`), 0600)
+
+	os.Setenv(MasterKeyEnv, base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	defer os.Unsetenv(MasterKeyEnv)
+	key, err := LoadMasterKey("")
+	if err != nil || len(key) != 32 {
+		t.Fatalf("Expected master key got %v %v", key, err)
+	}
+
+	// The plaintext credential is encrypted as soon as it is loaded.
+	if _, err = LoadRegistry(path, key); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(b), "abcd") || !strings.Contains(string(b), "sealed") {
+		t.Fatalf("Expected sealed credential got %s", b)
+	}
+
+	r, err := LoadRegistry(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred, _ := r.Credential("fart app", "gcm"); cred.Auth != "abcd" {
+		t.Fatalf("Expected decrypted auth got %+v", cred)
+	}
+	if _, err = LoadRegistry(path, nil); err == nil {
+		t.Fatal("Expected error without master key")
+	}
+	if _, err = LoadRegistry(path, make([]byte, 32)[:31]); err == nil {
+		t.Fatal("Expected error with wrong master key")
+	}
+}
+
+// rejectingService rejects every auth but good.
+type rejectingService struct {
+	good string
+}
+
+func (s rejectingService) Push(n *Notification, auth string) *PushStatus {
+	ps := NewPushStatus(n)
+	if auth != s.good {
+		ps.Errors[""] = fmt.Errorf("Unauthorized")
+		return ps
+	}
+	ps.Successes = len(n.DeviceTokens)
+	return ps
+}
+
+func TestRegistryRotate(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.Services["test"] = rejectingService{"old"}
+	sm.Registry.Put(&App{Name: "fart app", Credentials: map[string]*Credential{"test": {Auth: "old"}}})
+
+	if _, err = sm.Registry.Rotate("other app", "test", &Credential{Auth: "new"}, time.Hour); err == nil {
+		t.Fatal("Expected UnknownApp")
+	}
+	_, err = sm.Registry.Rotate("fart app", "test", &Credential{Auth: "new"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := sm.Registry.Credentials("fart app", "test")
+	if len(creds) != 2 || creds[0].Auth != "new" || creds[1].Auth != "old" {
+		t.Fatalf("Expected new and old credentials got %+v", creds)
+	}
+
+	// The new credential is not accepted yet, the old one still is.
+	job := &Notification{AppName: "fart app", Provider: "test", DeviceTokens: []string{"a"}}
+	sm.Work(job, "")
+	if !job.Status.Ok() {
+		t.Fatalf("Expected job sent with the old credential got %s", job.Status)
+	}
+
+	_, err = sm.Registry.Rotate("fart app", "test", &Credential{Auth: "newer"}, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds = sm.Registry.Credentials("fart app", "test"); len(creds) != 2 || creds[1].Auth != "old" {
+		t.Fatalf("Expected new credential retired straight away got %+v", creds)
+	}
+}
+
+// retiringService records the credentials it was told to retire.
+type retiringService struct {
+	rejectingService
+	retired *[]string
+}
+
+func (s retiringService) Retire(appName, authKey string) {
+	*s.retired = append(*s.retired, appName+":"+authKey)
+}
+
+func TestRetireCredentials(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	var retired []string
+	sm.Services["test"] = retiringService{rejectingService{"new"}, &retired}
+	sm.Registry.Put(&App{Name: "fart app", Credentials: map[string]*Credential{"test": {Auth: "old"}}})
+	sm.Registry.Rotate("fart app", "test", &Credential{Auth: "new"}, time.Hour)
+
+	sm.RetireCredentials(time.Now())
+	if len(retired) != 0 {
+		t.Fatalf("Nothing should be retired during the grace period got %v", retired)
+	}
+	sm.RetireCredentials(time.Now().Add(2 * time.Hour))
+	if len(retired) != 1 || retired[0] != "fart app:old" {
+		t.Fatalf("Expected the old credential retired got %v", retired)
+	}
+
+	// Replacing the app retires what it no longer has straight away.
+	retired = nil
+	sm.Registry.Rotate("fart app", "test", &Credential{Auth: "newer"}, time.Hour)
+	sm.Registry.Put(&App{Name: "fart app", Credentials: map[string]*Credential{"test": {Auth: "newest"}}})
+	sm.RetireCredentials(time.Now())
+	if len(retired) != 3 || retired[0] != "fart app:newer" || retired[1] != "fart app:new" || retired[2] != "fart app:old" {
+		t.Fatalf("Expected the replaced credentials retired got %v", retired)
+	}
+	retired = nil
+	sm.Registry.Delete("fart app")
+	sm.RetireCredentials(time.Now())
+	sm.RetireCredentials(time.Now())
+	if len(retired) != 1 || retired[0] != "fart app:newest" {
+		t.Fatalf("Expected the deleted credential retired once got %v", retired)
+	}
+}
+
+func TestCertNotAfter(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.fart.app"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	app := &App{Name: "fart app", Credentials: map[string]*Credential{"apns": {Auth: auth}}}
+	NewRegistry().Put(app)
+	if expires := app.Credentials["apns"].ExpiresAt; expires == nil || !expires.Equal(notAfter) {
+		t.Fatalf("Expected expiry %s got %v", notAfter, expires)
+	}
+	if _, ok := certNotAfter("abcd"); ok {
+		t.Fatal("Expected no certificate")
+	}
+}
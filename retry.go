@@ -0,0 +1,119 @@
+package manbearpig
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultRetryAttempts is how many times a job is sent again
+	// before it is abandoned, unless its app says otherwise.
+	DefaultRetryAttempts int = 10
+	// DefaultRetryMaxAge is how long after it was accepted a job is
+	// still sent again, unless its app says otherwise.
+	DefaultRetryMaxAge time.Duration = 24 * time.Hour
+	// RetryBaseDelay is the backoff before the first retry, doubled
+	// after each one.
+	RetryBaseDelay time.Duration = time.Second
+	// RetryMaxDelay caps the backoff, a Retry-After from the
+	// provider may still ask for longer.
+	RetryMaxDelay time.Duration = 10 * time.Minute
+)
+
+// Reasons a job was abandoned instead of sent again.
+const (
+	AbandonMaxAttempts = "MaxAttempts" // the retry policy allows no more attempts
+	AbandonMaxAge      = "MaxAge"      // the next attempt would be after the max age
+)
+
+// RetryPolicy limits how long an app's jobs are retried. Zero values
+// use the defaults.
+type RetryPolicy struct {
+	MaxAttempts int `json:"max_attempts,omitempty"` // retries after the first send
+	MaxAge      int `json:"max_age,omitempty"`      // seconds since the job was accepted
+}
+
+// validate rejects negative limits.
+func (p *RetryPolicy) validate() error {
+	if p.MaxAttempts < 0 || p.MaxAge < 0 {
+		return fmt.Errorf("InvalidRetryPolicy")
+	}
+	return nil
+}
+
+// limits returns the policy with the defaults filled in.
+func (p *RetryPolicy) limits() (attempts int, maxAge time.Duration) {
+	attempts, maxAge = DefaultRetryAttempts, DefaultRetryMaxAge
+	if p == nil {
+		return attempts, maxAge
+	}
+	if p.MaxAttempts > 0 {
+		attempts = p.MaxAttempts
+	}
+	if p.MaxAge > 0 {
+		maxAge = time.Duration(p.MaxAge) * time.Second
+	}
+	return attempts, maxAge
+}
+
+// jitter returns a random duration in [0, n), replaced by tests.
+var jitter = func(n int64) time.Duration {
+	return time.Duration(rand.Int63n(n))
+}
+
+// Backoff returns how long to wait before a retry: RetryBaseDelay
+// doubled for every earlier retry up to RetryMaxDelay, of which a
+// random half is taken off so jobs failing together spread out. A
+// provider's Retry-After is the floor.
+func Backoff(retry int, floor time.Duration) time.Duration {
+	delay := RetryBaseDelay
+	for i := 1; i < retry && delay < RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	delay = delay/2 + jitter(int64(delay/2)+1)
+	if delay < floor {
+		delay = floor
+	}
+	return delay
+}
+
+// retry schedules a job to be sent again after its backoff, or fails
+// it once the retry policy of its app is used up.
+func (sm *ServiceManager) retry(job *Notification, auth string, floor time.Duration) {
+	var policy *RetryPolicy
+	if app, ok := sm.Registry.Get(job.AppName); ok {
+		policy = app.Retry
+	}
+	attempts, maxAge := policy.limits()
+
+	// A scheduled job is as old as the time it was sent at.
+	start := job.CreatedAt
+	if job.SendAt != nil && job.SendAt.After(start) {
+		start = *job.SendAt
+	}
+	job.Retries++
+	delay := Backoff(job.Retries, floor)
+	at := time.Now().Add(delay)
+	switch {
+	case job.Retries > attempts:
+		job.AbandonReason = AbandonMaxAttempts
+	case !start.IsZero() && at.Sub(start) > maxAge:
+		job.AbandonReason = AbandonMaxAge
+	}
+	if job.AbandonReason != "" {
+		log.Printf("Abandoning job %s after %d retries: %s", job.Guid, job.Retries-1, job.AbandonReason)
+		sm.Metrics.Abandoned.Add(1, job.Provider, job.AppName, job.AbandonReason)
+		sm.finish(job, JobFailed)
+		return
+	}
+
+	log.Printf("Retrying job %s in %v", job.Guid, delay)
+	sm.Metrics.Retried.Add(1, job.Provider, job.AppName)
+	sm.Statuses.Set(job, JobRetrying)
+	sm.Retries.Schedule(&QueuedJob{job, auth}, at)
+}
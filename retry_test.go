@@ -0,0 +1,97 @@
+package manbearpig
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	defer func(j func(int64) time.Duration) { jitter = j }(jitter)
+	for _, max := range []bool{false, true} {
+		jitter = func(n int64) time.Duration {
+			if max {
+				return time.Duration(n - 1)
+			}
+			return 0
+		}
+		tests := []struct {
+			retry    int
+			floor    time.Duration
+			min, max time.Duration
+		}{
+			{1, 0, time.Second / 2, time.Second},
+			{3, 0, 2 * time.Second, 4 * time.Second},
+			{30, 0, RetryMaxDelay / 2, RetryMaxDelay},
+			{1, time.Minute, time.Minute, time.Minute},
+			{30, time.Hour, time.Hour, time.Hour},
+		}
+		for _, test := range tests {
+			delay := Backoff(test.retry, test.floor)
+			if delay < test.min || delay > test.max {
+				t.Errorf("Retry %d floor %v: expected between %v and %v got %v", test.retry, test.floor, test.min, test.max, delay)
+			}
+		}
+	}
+}
+
+func TestRetryScheduler(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	sent := make(chan string, 3)
+	s := NewScheduler(func(qj *QueuedJob) bool {
+		sent <- qj.Job.Guid
+		return true
+	}, quit)
+
+	now := time.Now()
+	s.Schedule(&QueuedJob{Job: &Notification{Guid: "c"}}, now.Add(60*time.Millisecond))
+	s.Schedule(&QueuedJob{Job: &Notification{Guid: "a"}}, now.Add(-time.Second))
+	s.Schedule(&QueuedJob{Job: &Notification{Guid: "b"}}, now.Add(30*time.Millisecond))
+	for _, expected := range []string{"a", "b", "c"} {
+		select {
+		case guid := <-sent:
+			if guid != expected {
+				t.Fatalf("Expected %s got %s", expected, guid)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", expected)
+		}
+	}
+	if s.Len() != 0 {
+		t.Fatalf("Expected nothing left got %d", s.Len())
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	if err = sm.Registry.Put(&App{Name: "bad app", Retry: &RetryPolicy{MaxAttempts: -1}}); err == nil {
+		t.Fatal("Expected InvalidRetryPolicy")
+	}
+	sm.Registry.Put(&App{Name: "fart app", Retry: &RetryPolicy{MaxAttempts: 1, MaxAge: 3600}})
+
+	job := &Notification{AppName: "fart app", Provider: "test", DeviceTokens: []string{"a"}}
+	job.Init()
+	sm.retry(job, "", 0)
+	if job.AbandonReason != "" || sm.Retries.Len() != 1 {
+		t.Fatalf("Expected the first retry scheduled got %q %d", job.AbandonReason, sm.Retries.Len())
+	}
+	sm.retry(job, "", 0)
+	js, _ := sm.Statuses.Get(job.Guid)
+	if js.State != JobFailed || js.Reason != AbandonMaxAttempts {
+		t.Fatalf("Expected abandoned after max attempts got %+v", js)
+	}
+
+	// A Retry-After past the max age is not waited for.
+	job = &Notification{AppName: "fart app", Provider: "test", DeviceTokens: []string{"a"}}
+	job.Init()
+	sm.retry(job, "", 2*time.Hour)
+	if job.AbandonReason != AbandonMaxAge {
+		t.Fatalf("Expected abandoned for its age got %q", job.AbandonReason)
+	}
+	if n := sm.Metrics.Abandoned.Get("test", "fart app", AbandonMaxAge); n != 1 {
+		t.Fatalf("Expected 1 abandoned for its age got %d", n)
+	}
+}
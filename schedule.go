@@ -0,0 +1,362 @@
+package manbearpig
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// localSendTimeLayouts are the accepted forms of a local send time,
+// a wall clock time without a zone.
+var localSendTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+// parseLocalSendTime returns the instant a local send time is at in loc.
+func parseLocalSendTime(value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range localSendTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("InvalidLocalSendTime")
+}
+
+// scheduleBatch is the tokens of a job that are due at the same time.
+type scheduleBatch struct {
+	at     time.Time
+	tokens []string
+}
+
+// scheduled reports whether a job waits for its send time instead of
+// being sent straight away.
+func (n *Notification) scheduled(now time.Time) bool {
+	return n.LocalSendTime != "" || (n.SendAt != nil && n.SendAt.After(now))
+}
+
+// timeZone returns the time zone of a device token, UTC if none.
+func (n *Notification) timeZone(token string) (*time.Location, error) {
+	name := n.TimeZones[token]
+	if name == "" {
+		name = n.TimeZone
+	}
+	return time.LoadLocation(name)
+}
+
+// batches returns when the tokens of a scheduled job are due,
+// earliest first. Tokens due at the same instant, even in different
+// time zones, are sent together.
+func (n *Notification) batches() ([]*scheduleBatch, error) {
+	if n.LocalSendTime == "" {
+		if n.SendAt == nil {
+			return nil, nil
+		}
+		return []*scheduleBatch{{*n.SendAt, n.DeviceTokens}}, nil
+	}
+
+	byTime := map[time.Time]*scheduleBatch{}
+	var batches []*scheduleBatch
+	for _, token := range n.DeviceTokens {
+		loc, err := n.timeZone(token)
+		if err != nil {
+			return nil, fmt.Errorf("InvalidTimeZone")
+		}
+		at, err := parseLocalSendTime(n.LocalSendTime, loc)
+		if err != nil {
+			return nil, err
+		}
+		at = at.UTC()
+		batch, ok := byTime[at]
+		if !ok {
+			batch = &scheduleBatch{at: at}
+			byTime[at] = batch
+			batches = append(batches, batch)
+		}
+		batch.tokens = append(batch.tokens, token)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].at.Before(batches[j].at) })
+	return batches, nil
+}
+
+// validateSchedule checks the send time and time zones of a job.
+func validateSchedule(job *Notification) []*ValidationError {
+	if job.LocalSendTime == "" {
+		return nil
+	}
+	if job.SendAt != nil {
+		return []*ValidationError{{"send_at", "InvalidSchedule", "only one of send_at and local_send_time may be set"}}
+	}
+	if _, err := parseLocalSendTime(job.LocalSendTime, time.UTC); err != nil {
+		return []*ValidationError{{"local_send_time", "InvalidLocalSendTime", "local_send_time must look like 2006-01-02T15:04"}}
+	}
+	var errs []*ValidationError
+	if _, err := time.LoadLocation(job.TimeZone); err != nil {
+		errs = append(errs, &ValidationError{"time_zone", "InvalidTimeZone", fmt.Sprintf("unknown time zone %q", job.TimeZone)})
+	}
+	for _, token := range job.DeviceTokens {
+		name, ok := job.TimeZones[token]
+		if !ok {
+			continue
+		}
+		if _, err := time.LoadLocation(name); err != nil {
+			errs = append(errs, &ValidationError{fmt.Sprintf("time_zones[%s]", token), "InvalidTimeZone", fmt.Sprintf("unknown time zone %q", name)})
+		}
+	}
+	return errs
+}
+
+// schedule holds an accepted job until it is due. A job with a local
+// send time whose tokens are due at different times is sent as a job
+// derived from it per time, it finishes once all of them did.
+func (sm *ServiceManager) schedule(job *Notification, auth string) error {
+	batches, err := job.batches()
+	if err != nil {
+		return err
+	}
+	sm.Statuses.Set(job, JobScheduled)
+	if len(batches) == 1 {
+		job.SendAt = &batches[0].at
+		sm.Scheduled.Schedule(&QueuedJob{job, auth}, batches[0].at)
+		return nil
+	}
+
+	job.Status = NewPushStatus(job)
+	job.Status.Auth = auth
+	job.unsent = append([]string(nil), job.DeviceTokens...)
+	for _, batch := range batches {
+		d, err := job.Derive(batch.tokens)
+		if err != nil {
+			return err
+		}
+		at := batch.at
+		d.SendAt = &at
+		d.LocalSendTime = ""
+		d.TimeZone = ""
+		d.TimeZones = nil
+		sm.derived.Lock()
+		job.pending++
+		job.waiting++
+		sm.derived.Unlock()
+		sm.Statuses.Set(d, JobScheduled)
+		sm.Scheduled.Schedule(&QueuedJob{d, auth}, at)
+	}
+	return nil
+}
+
+// release hands a scheduled job to the workers once it is due,
+// reporting false if its provider is too busy to take it yet.
+func (sm *ServiceManager) release(qj *QueuedJob) bool {
+	if !sm.reserve(qj.Job) {
+		return false
+	}
+	if qj.Job.parent != nil {
+		// Sent on its own from now on, even after a restart.
+		err := sm.Queue.Put(qj)
+		if err != nil {
+			log.Printf("Queue %s: %s", qj.Job.Guid, err)
+		}
+		sm.unschedule(qj.Job)
+	}
+	sm.Statuses.Set(qj.Job, JobQueued)
+	sm.put(qj)
+	return true
+}
+
+// unschedule takes the tokens of a derived job that is no longer
+// waiting out of those the Queue keeps of the job it was derived
+// from, which is kept only while some of its tokens are waiting. The
+// job itself keeps all of its tokens for its results.
+func (sm *ServiceManager) unschedule(job *Notification) {
+	parent := job.parent
+	sm.derived.Lock()
+	parent.waiting--
+	gone := map[string]bool{}
+	for _, token := range job.DeviceTokens {
+		gone[token] = true
+	}
+	var tokens []string
+	for _, token := range parent.unsent {
+		if !gone[token] {
+			tokens = append(tokens, token)
+		}
+	}
+	parent.unsent = tokens
+	cp := *parent
+	cp.DeviceTokens = tokens
+	waiting := parent.waiting
+	auth := parent.Status.Auth
+	sm.derived.Unlock()
+
+	if waiting == 0 {
+		sm.ack(parent)
+		return
+	}
+	err := sm.Queue.Put(&QueuedJob{&cp, auth})
+	if err != nil {
+		log.Printf("Queue %s: %s", parent.Guid, err)
+	}
+}
+
+// ErrNotScheduled is returned when canceling a job that is not
+// waiting for its send time.
+var ErrNotScheduled = fmt.Errorf("NotScheduled")
+
+// Cancel keeps a scheduled job, or what of it is not due yet, from
+// being sent.
+func (sm *ServiceManager) Cancel(id string) error {
+	canceled := sm.Scheduled.Cancel(func(qj *QueuedJob) bool {
+		return qj.Job.Guid == id || qj.Job.ParentID == id
+	})
+	if len(canceled) == 0 {
+		return ErrNotScheduled
+	}
+	for _, qj := range canceled {
+		log.Printf("Canceled job %s", qj.Job.Guid)
+		if qj.Job.parent != nil {
+			sm.unschedule(qj.Job)
+		}
+		sm.finish(qj.Job, JobCanceled)
+	}
+	return nil
+}
+
+// schedulerItem is a job waiting in a Scheduler.
+type schedulerItem struct {
+	at time.Time
+	qj *QueuedJob
+}
+
+// schedulerHeap orders the waiting jobs by when they are due.
+type schedulerHeap []*schedulerItem
+
+func (h schedulerHeap) Len() int            { return len(h) }
+func (h schedulerHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h schedulerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *schedulerHeap) Push(x interface{}) { *h = append(*h, x.(*schedulerItem)) }
+func (h *schedulerHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// busyDelay is how long a Scheduler waits before handing a job to
+// send again when it was not taken.
+const busyDelay = 100 * time.Millisecond
+
+// Scheduler holds jobs waiting to be sent at a later time, retries
+// and jobs with a send time, and hands each to send once it is due,
+// with a single timer and goroutine for all of them. send must not
+// block, it reports false if the job can't be taken yet, e.g. because
+// its provider is busy, and the job is handed to it again a little
+// later. Jobs still waiting when quit is closed stay in the Queue for
+// the next start.
+type Scheduler struct {
+	send  func(*QueuedJob) bool
+	items schedulerHeap
+	wake  chan struct{}
+	quit  <-chan struct{}
+	mu    sync.Mutex
+}
+
+// NewScheduler starts a scheduler that runs until quit is closed.
+func NewScheduler(send func(*QueuedJob) bool, quit <-chan struct{}) *Scheduler {
+	s := &Scheduler{send: send, wake: make(chan struct{}, 1), quit: quit}
+	go s.run()
+	return s
+}
+
+// Schedule sends a job at the given time.
+func (s *Scheduler) Schedule(qj *QueuedJob, at time.Time) {
+	s.mu.Lock()
+	heap.Push(&s.items, &schedulerItem{at, qj})
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel removes the waiting jobs match is true for and returns them.
+func (s *Scheduler) Cancel(match func(*QueuedJob) bool) []*QueuedJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var canceled []*QueuedJob
+	kept := s.items[:0]
+	for _, item := range s.items {
+		if match(item.qj) {
+			canceled = append(canceled, item.qj)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	for i := len(kept); i < len(s.items); i++ {
+		s.items[i] = nil
+	}
+	s.items = kept
+	heap.Init(&s.items)
+	return canceled
+}
+
+// Len returns the number of jobs waiting.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+// due removes the jobs due at now and returns them along with how
+// long until the next one, 0 if none is left.
+func (s *Scheduler) due(now time.Time) ([]*QueuedJob, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []*QueuedJob
+	for len(s.items) > 0 && !s.items[0].at.After(now) {
+		jobs = append(jobs, heap.Pop(&s.items).(*schedulerItem).qj)
+	}
+	if len(s.items) == 0 {
+		return jobs, 0
+	}
+	return jobs, s.items[0].at.Sub(now)
+}
+
+func (s *Scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now := time.Now()
+		jobs, next := s.due(now)
+		for _, qj := range jobs {
+			if s.send(qj) {
+				continue
+			}
+			// Its provider is busy, the others are not held up.
+			s.mu.Lock()
+			heap.Push(&s.items, &schedulerItem{now.Add(busyDelay), qj})
+			s.mu.Unlock()
+			if next == 0 || next > busyDelay {
+				next = busyDelay
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var wait <-chan time.Time
+		if next > 0 {
+			timer.Reset(next)
+			wait = timer.C
+		}
+		select {
+		case <-wait:
+		case <-s.wake:
+		case <-s.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package manbearpig
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSchedulerCancel(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	sent := make(chan string, 3)
+	s := NewScheduler(func(qj *QueuedJob) bool {
+		sent <- qj.Job.Guid
+		return true
+	}, quit)
+
+	later := time.Now().Add(time.Hour)
+	for _, guid := range []string{"a", "b", "c"} {
+		s.Schedule(&QueuedJob{Job: &Notification{Guid: guid}}, later)
+	}
+	canceled := s.Cancel(func(qj *QueuedJob) bool { return qj.Job.Guid != "b" })
+	if len(canceled) != 2 || s.Len() != 1 {
+		t.Fatalf("Expected a and c canceled got %d, %d left", len(canceled), s.Len())
+	}
+	select {
+	case guid := <-sent:
+		t.Fatalf("Nothing is due yet got %s", guid)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestNotificationBatches(t *testing.T) {
+	job := &Notification{
+		DeviceTokens:  []string{"ny", "la", "utc", "ny2"},
+		LocalSendTime: "2030-03-01T09:00",
+		TimeZones:     map[string]string{"ny": "America/New_York", "ny2": "America/New_York", "la": "America/Los_Angeles"},
+	}
+	batches, err := job.batches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		at     string
+		tokens int
+	}{
+		{"2030-03-01T09:00:00Z", 1},
+		{"2030-03-01T14:00:00Z", 2},
+		{"2030-03-01T17:00:00Z", 1},
+	}
+	if len(batches) != len(expected) {
+		t.Fatalf("Expected %d batches got %d", len(expected), len(batches))
+	}
+	for i, e := range expected {
+		if at := batches[i].at.Format(time.RFC3339); at != e.at || len(batches[i].tokens) != e.tokens {
+			t.Errorf("Batch %d: expected %d tokens at %s got %v at %s", i, e.tokens, e.at, batches[i].tokens, at)
+		}
+	}
+
+	job.TimeZones["la"] = "Mars/Olympus_Mons"
+	errs := validateSchedule(job)
+	if len(errs) != 1 || errs[0].Field != "time_zones[la]" || errs[0].Code != "InvalidTimeZone" {
+		t.Fatalf("Expected an invalid time zone for la got %+v", errs)
+	}
+	sendAt := time.Now()
+	job.SendAt = &sendAt
+	if errs = validateSchedule(job); len(errs) != 1 || errs[0].Code != "InvalidSchedule" {
+		t.Fatalf("Expected InvalidSchedule got %+v", errs)
+	}
+}
+
+func TestScheduledJobs(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	pushed := make(chan *Notification, 2)
+	sm.Services["test"] = testService{pushed}
+	ap, _ := NewAPIServer("9999", sm)
+
+	// Due straight away for utc, in hours for la.
+	job := &Notification{
+		Provider:      "test",
+		DeviceTokens:  []string{"utc", "la"},
+		Payload:       map[string]interface{}{"a": 1},
+		LocalSendTime: time.Now().UTC().Format("2006-01-02T15:04"),
+		TimeZones:     map[string]string{"la": "America/Los_Angeles"},
+	}
+	sendAt := time.Now().Add(time.Hour)
+	later := &Notification{Provider: "test", DeviceTokens: []string{"a"}, Payload: map[string]interface{}{"a": 1}, SendAt: &sendAt}
+	err = sm.Enqueue([]*Notification{job, later}, "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent *Notification
+	select {
+	case sent = <-pushed:
+		if len(sent.DeviceTokens) != 1 || sent.DeviceTokens[0] != "utc" || sent.ParentID != job.Guid {
+			t.Fatalf("Expected only utc sent got %+v", sent)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for utc")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		js, _ := sm.Statuses.Get(sent.Guid)
+		if js.Finished() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected utc done got %+v", js)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if js, _ := sm.Statuses.Get(job.Guid); js.State != JobScheduled || sm.Scheduled.Len() != 2 {
+		t.Fatalf("Expected la still scheduled got %+v", js)
+	}
+	if pending, _ := sm.Queue.Pending(); len(pending) != 2 {
+		t.Fatalf("Expected the job and the later one kept in the queue got %d", len(pending))
+	}
+
+	for _, id := range []string{job.Guid, later.Guid} {
+		w := httptest.NewRecorder()
+		ap.Handler().ServeHTTP(w, httptest.NewRequest("DELETE", "/jobs/"+id, nil))
+		if w.Code != 204 {
+			t.Fatalf("Expected %s canceled got %d %s", id, w.Code, w.Body.String())
+		}
+	}
+	if js, _ := sm.Statuses.Get(job.Guid); js.State != JobDone {
+		t.Fatalf("Expected the job done for utc got %+v", js)
+	}
+	if js, _ := sm.Statuses.Get(later.Guid); js.State != JobCanceled {
+		t.Fatalf("Expected the later job canceled got %+v", js)
+	}
+	if sm.Scheduled.Len() != 0 {
+		t.Fatalf("Expected nothing scheduled got %d", sm.Scheduled.Len())
+	}
+	if pending, _ := sm.Queue.Pending(); len(pending) != 0 {
+		t.Fatalf("Expected nothing left in the queue got %d", len(pending))
+	}
+
+	w := httptest.NewRecorder()
+	ap.Handler().ServeHTTP(w, httptest.NewRequest("DELETE", "/jobs/"+later.Guid, nil))
+	if w.Code != 409 {
+		t.Fatalf("Expected 409 for a job no longer scheduled got %d", w.Code)
+	}
+}
+
+func TestScheduledJobFailed(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.Services["test"] = rejectingService{"good"}
+	sink := &MemorySink{}
+	sm.Sinks = append(sm.Sinks, sink)
+
+	// Due for both zones, at different times.
+	job := &Notification{
+		Provider:      "test",
+		DeviceTokens:  []string{"utc", "la"},
+		Payload:       map[string]interface{}{"a": 1},
+		LocalSendTime: time.Now().UTC().Add(-48 * time.Hour).Format("2006-01-02T15:04"),
+		TimeZones:     map[string]string{"la": "America/Los_Angeles"},
+	}
+	err = sm.Enqueue([]*Notification{job}, "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		js, _ := sm.Statuses.Get(job.Guid)
+		if js.Finished() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the job failed got %+v", js)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	js, _ := sm.Statuses.Get(job.Guid)
+	var status struct{ Errors map[string]string }
+	json.Unmarshal(js.Status, &status)
+	if js.State != JobFailed || status.Errors["utc"] != "Unauthorized" || status.Errors["la"] != "Unauthorized" {
+		t.Fatalf("Expected both tokens failed got %+v %s", js, js.Status)
+	}
+	dl, ok := sm.DeadLetters.Get(job.Guid)
+	if !ok {
+		t.Fatal("Expected a dead letter")
+	}
+	if len(dl.Job.DeviceTokens) != 2 || dl.Job.DeviceTokens[0] != "utc" || dl.Job.DeviceTokens[1] != "la" {
+		t.Fatalf("Expected both tokens in the dead letter got %v", dl.Job.DeviceTokens)
+	}
+	// Errors are processed in the background, wait for them.
+	for len(sink.Events()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the rejected auth reported per batch got %+v", sink.Events())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// blockingService sends nothing until unblock is closed.
+type blockingService struct {
+	unblock chan struct{}
+}
+
+func (s blockingService) Push(n *Notification, auth string) *PushStatus {
+	<-s.unblock
+	return NewPushStatus(n)
+}
+
+func TestSchedulerBusyProvider(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	unblock := make(chan struct{})
+	sm.Services["slow"] = blockingService{unblock}
+	sm.PoolConfigs["slow"] = PoolConfig{Workers: 1, QueueSize: 1}
+	pushed := make(chan *Notification, 1)
+	sm.Services["test"] = testService{pushed}
+
+	// More slow jobs than its pool takes, due before the other one.
+	var jobs []*Notification
+	sendAt := time.Now().Add(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, &Notification{Provider: "slow", DeviceTokens: []string{"a"}, Payload: map[string]interface{}{"a": 1}, SendAt: &sendAt})
+	}
+	testAt := sendAt.Add(20 * time.Millisecond)
+	jobs = append(jobs, &Notification{Provider: "test", DeviceTokens: []string{"a"}, Payload: map[string]interface{}{"a": 1}, SendAt: &testAt})
+	err = sm.Enqueue(jobs, "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the test job sent while slow is busy")
+	}
+	close(unblock)
+	deadline := time.Now().Add(time.Second)
+	for _, job := range jobs[:3] {
+		for {
+			js, _ := sm.Statuses.Get(job.Guid)
+			if js.Finished() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected every slow job sent got %+v", js)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package manbearpig
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// MasterKeyEnv is the environment variable the master key is read
+// from when no key file is given.
+const MasterKeyEnv string = "MANBEARPIG_MASTER_KEY"
+
+// LoadMasterKey reads the base64 encoded 32 byte key credentials are
+// encrypted with from the file at path, or MasterKeyEnv if path is
+// empty. A nil key means credentials are stored in plaintext.
+func LoadMasterKey(path string) ([]byte, error) {
+	encoded := os.Getenv(MasterKeyEnv)
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("InvalidMasterKey")
+	}
+	return key, nil
+}
+
+// seal encrypts plaintext with AES-256-GCM, returning the base64
+// encoded nonce followed by the ciphertext.
+func seal(key, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// unseal reverses seal.
+func unseal(key []byte, sealed string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return nil, fmt.Errorf("InvalidSealedCredential")
+	}
+	plaintext, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("InvalidSealedCredential")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,17 +1,22 @@
 package manbearpig
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // SMGlobal [...]
 var SMGlobal *ServiceManager
 
 // Keep track of the current state of work being done.
+// Fields are updated atomically.
 type Stats struct {
-	Running    int
+	Running    int64
 	APNS       uint64
 	APNSErrors uint64
 	GCM        uint64
@@ -20,8 +25,21 @@ type Stats struct {
 	C2DMErrors uint64
 }
 
+// counters returns the push and error counters of a provider.
+func (s *Stats) counters(provider string) (*uint64, *uint64) {
+	switch provider {
+	case "apns", "apns2":
+		return &s.APNS, &s.APNSErrors
+	case "gcm", "fcm":
+		return &s.GCM, &s.GCMErrors
+	case "c2dm":
+		return &s.C2DM, &s.C2DMErrors
+	}
+	return nil, nil
+}
+
 // Service is an abstraction of the final Push endpoint. Currently
-// apns/c2dm/gcm are the options
+// apns/apns2/c2dm/gcm/fcm are the options
 type Service interface {
 	// Push does the actual sending depending on the
 	// provider. A PushStatus object is returned to indicate if there
@@ -32,10 +50,302 @@ type Service interface {
 // ServiceManager routes all requests for Push to the appropriate
 // Push object.
 type ServiceManager struct {
-	Services map[string]Service // Define the available services apns/gcm/c2dm.
+	Services map[string]Service // Define the available services apns/apns2/gcm/fcm/c2dm.
 	Quit     chan struct{}      // Shutdown signal for go routines
-	Quitting bool               // Prevent adding to the jobs channel after closing.
+	Quitting bool               // Prevent adding to the jobs channel after closing, guarded by mu.
 	Stats    *Stats             // Keep track of running jobs
+	Metrics  *Metrics           // Exposed on /metrics
+	Registry *Registry          // Apps and their credentials.
+	Queue    Queue              // Accepted jobs that have not finished yet.
+	Statuses *StatusStore       // State of recent jobs for the api.
+	Retries  *Scheduler         // Jobs waiting to be sent again.
+	// Jobs waiting for their send time.
+	Scheduled *Scheduler
+	// Failed jobs kept to be looked at and replayed.
+	DeadLetters *DeadLetters
+	// Delivers job reports to callback urls.
+	Callbacks *Callbacks
+	// Receive invalid/unregistered/canonicalized tokens and rejected auth.
+	Sinks []FeedbackSink
+	// Worker pool sizes by provider, the defaults are used for
+	// any provider missing. Pools are started on first use.
+	PoolConfigs map[string]PoolConfig
+	pools       map[string]*workerPool
+	mu          sync.Mutex
+	// Guards the results of jobs sent as derived jobs.
+	derived sync.Mutex
+}
+
+// pool returns the worker pool of a provider, starting it if needed.
+func (sm *ServiceManager) pool(provider string) *workerPool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	pool, ok := sm.pools[provider]
+	if !ok {
+		pool = newWorkerPool(sm.PoolConfigs[provider], func(qj *QueuedJob) {
+			sm.Work(qj.Job, qj.Auth)
+		})
+		sm.pools[provider] = pool
+	}
+	return pool
+}
+
+// Enqueue stores new jobs in the Queue and hands them to the workers
+// of their provider, or holds them until their send time. Either
+// every job is accepted or, if a provider has no room left, none are
+// and ErrQueueFull is returned.
+// Once it returns the jobs will be sent even if the process restarts.
+func (sm *ServiceManager) Enqueue(jobs []*Notification, auth string) error {
+	sm.mu.Lock()
+	quitting := sm.Quitting
+	sm.mu.Unlock()
+	if quitting {
+		return ErrShuttingDown
+	}
+
+	// Reserve room with every provider before accepting anything.
+	now := time.Now()
+	counts := map[string]int{}
+	for _, job := range jobs {
+		if _, ok := sm.Services[job.Provider]; ok && !job.scheduled(now) {
+			counts[job.Provider]++
+		}
+	}
+	reserved := map[string]int{}
+	release := func() {
+		for provider, n := range reserved {
+			sm.pool(provider).release(n)
+		}
+	}
+	for provider, n := range counts {
+		err := sm.pool(provider).reserve(n)
+		if err != nil {
+			release()
+			return err
+		}
+		reserved[provider] = n
+	}
+
+	for i, job := range jobs {
+		err := job.Init()
+		if err == nil {
+			err = sm.Queue.Put(&QueuedJob{job, auth})
+		}
+		if err != nil {
+			for _, accepted := range jobs[:i] {
+				sm.ack(accepted)
+			}
+			release()
+			return err
+		}
+	}
+
+	for _, job := range jobs {
+		if job.scheduled(now) {
+			sm.hold(job, auth)
+			continue
+		}
+		sm.Statuses.Set(job, JobQueued)
+		if _, ok := sm.Services[job.Provider]; !ok {
+			// Nothing to send with, Work drops it.
+			sm.Work(job, auth)
+			continue
+		}
+		sm.pool(job.Provider).put(&QueuedJob{job, auth})
+	}
+	return nil
+}
+
+// dispatch hands an already accepted job to the workers, waiting
+// for room if the provider is busy.
+func (sm *ServiceManager) dispatch(qj *QueuedJob) {
+	if _, ok := sm.Services[qj.Job.Provider]; !ok {
+		sm.Work(qj.Job, qj.Auth)
+		return
+	}
+	sm.pool(qj.Job.Provider).force(qj)
+}
+
+// reserve makes room for an already accepted job with the workers,
+// reporting false if its provider is busy.
+func (sm *ServiceManager) reserve(job *Notification) bool {
+	if _, ok := sm.Services[job.Provider]; !ok {
+		return true
+	}
+	return sm.pool(job.Provider).reserve(1) == nil
+}
+
+// put hands a job room was reserved for to the workers.
+func (sm *ServiceManager) put(qj *QueuedJob) {
+	if _, ok := sm.Services[qj.Job.Provider]; !ok {
+		// Nothing to send with, Work drops it.
+		go sm.Work(qj.Job, qj.Auth)
+		return
+	}
+	sm.pool(qj.Job.Provider).put(qj)
+}
+
+// offer hands an already accepted job to the workers unless its
+// provider is busy, reporting whether it did.
+func (sm *ServiceManager) offer(qj *QueuedJob) bool {
+	if !sm.reserve(qj.Job) {
+		return false
+	}
+	sm.put(qj)
+	return true
+}
+
+// hold schedules a job until its send time, failing it if that
+// can't be worked out.
+func (sm *ServiceManager) hold(job *Notification, auth string) {
+	err := sm.schedule(job, auth)
+	if err != nil {
+		log.Printf("%s %+v", err, job)
+		job.Status = NewPushStatus(job)
+		job.Status.Errors[""] = err
+		job.Status.Auth = auth
+		sm.finish(job, JobFailed)
+	}
+}
+
+// Recover starts sending every job left in the Queue, e.g. from
+// before a restart, jobs whose send time has not come yet are
+// scheduled again. It returns the number of jobs replayed.
+func (sm *ServiceManager) Recover() (int, error) {
+	pending, err := sm.Queue.Pending()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var ready []*QueuedJob
+	for _, qj := range pending {
+		if qj.Job.scheduled(now) {
+			sm.hold(qj.Job, qj.Auth)
+			continue
+		}
+		sm.Statuses.Set(qj.Job, JobQueued)
+		ready = append(ready, qj)
+	}
+	go func() {
+		for _, qj := range ready {
+			log.Printf("Replaying job %s", qj.Job.Guid)
+			sm.dispatch(qj)
+		}
+	}()
+	return len(pending), nil
+}
+
+// resolve returns the auths to send a job with, in the order they
+// are tried, and fills in the settings of its registered app. An auth
+// sent with the job overrides the registered credentials, otherwise
+// credentials being rotated out are tried when the current one is
+// rejected.
+func (sm *ServiceManager) resolve(job *Notification, auth string) ([]string, error) {
+	app, ok := sm.Registry.Get(job.AppName)
+	if ok {
+		if job.CallbackURL == "" {
+			job.CallbackURL = app.CallbackURL
+		}
+		cred, ok := app.Credentials[job.Provider]
+		if ok && job.Topic == "" {
+			job.Topic = cred.Settings["topic"]
+		}
+		if ok && job.Environment == "" {
+			job.Environment = cred.Environment
+		}
+	}
+	if auth != "" {
+		return []string{auth}, nil
+	}
+
+	var auths []string
+	for _, cred := range sm.Registry.Credentials(job.AppName, job.Provider) {
+		if cred.Auth != "" {
+			auths = append(auths, cred.Auth)
+		}
+	}
+	if len(auths) == 0 {
+		return nil, fmt.Errorf("MissingCredentials")
+	}
+	return auths, nil
+}
+
+// finish records the final state of a job, reports it to the
+// job's callback url and removes it from the Queue. A derived job
+// finishes the job it was derived from once the other jobs derived
+// from it did, which is reported instead.
+func (sm *ServiceManager) finish(job *Notification, state string) {
+	if parent := job.parent; parent != nil {
+		sm.Statuses.Set(job, state)
+		sm.ack(job)
+		sm.derived.Lock()
+		if job.Retries > parent.Retries {
+			parent.Retries = job.Retries
+		}
+		if job.AbandonReason != "" {
+			parent.AbandonReason = job.AbandonReason
+		}
+		parent.Attempts = append(parent.Attempts, job.Attempts...)
+		parent.pending--
+		pending := parent.pending
+		switch {
+		case pending > 0:
+		case len(parent.Attempts) == 0 && parent.Status.Ok():
+			// Canceled before any of it was sent.
+			state = JobCanceled
+		case parent.Status.Ok():
+			state = JobDone
+		default:
+			state = JobFailed
+		}
+		if pending > 0 {
+			sm.Statuses.Set(parent, sm.parentState(parent, JobSending))
+		}
+		sm.derived.Unlock()
+		if pending > 0 {
+			return
+		}
+		job = parent
+	}
+	sm.Statuses.Set(job, state)
+	if state == JobFailed {
+		sm.deadLetter(job)
+	}
+	if job.CallbackURL != "" {
+		sm.Callbacks.Send(job.CallbackURL, NewCallbackReport(job, state))
+	}
+	sm.ack(job)
+}
+
+// fold merges the results of a derived job into those of the job it
+// was derived from, which is then in state unless some of it is still
+// waiting for its send time.
+func (sm *ServiceManager) fold(job *Notification, state string) {
+	parent := job.parent
+	if parent == nil {
+		return
+	}
+	sm.derived.Lock()
+	defer sm.derived.Unlock()
+	parent.Status = parent.Status.merge(job.DeviceTokens, job.Status)
+	sm.Statuses.Set(parent, sm.parentState(parent, state))
+}
+
+// parentState returns the state of a job sent as derived jobs that
+// has not finished yet, sm.derived must be held.
+func (sm *ServiceManager) parentState(parent *Notification, state string) string {
+	if parent.waiting > 0 {
+		return JobScheduled
+	}
+	return state
+}
+
+// ack removes a job that reached a terminal PushStatus from the Queue.
+func (sm *ServiceManager) ack(job *Notification) {
+	err := sm.Queue.Ack(job.Guid)
+	if err != nil {
+		log.Printf("Ack %s: %s", job.Guid, err)
+	}
 }
 
 // Work takes jobs and creates a new
@@ -44,42 +354,96 @@ type ServiceManager struct {
 func (sm *ServiceManager) Work(job *Notification, auth string) {
 	// Get the service type from available services and
 	// send the notification.
+	if job.Guid == "" {
+		err := job.Init()
+		if err != nil {
+			log.Printf("%s %+v", err, job)
+			return
+		}
+	}
 	provider, ok := sm.Services[job.Provider]
 	if !ok {
+		log.Printf("Unknown provider %s %+v", job.Provider, job)
+		job.Status = NewPushStatus(job)
+		job.Status.Errors[""] = fmt.Errorf("UnknownProvider")
+		job.Status.Auth = auth
+		sm.fold(job, JobFailed)
+		sm.finish(job, JobFailed)
 		return
 	}
-	err := job.Init()
+
+	auths, err := sm.resolve(job, auth)
 	if err != nil {
 		log.Printf("%s %+v", err, job)
+		job.Status = NewPushStatus(job)
+		job.Status.Errors[""] = err
+		job.Status.Auth = auth
+		sm.fold(job, JobFailed)
+		sm.finish(job, JobFailed)
 		return
 	}
 
-	pushStatus := provider.Push(job, auth)
+	sm.Statuses.Set(job, JobSending)
+	atomic.AddInt64(&sm.Stats.Running, 1)
+	var pushStatus *PushStatus
+	for i, a := range auths {
+		start := time.Now()
+		pushStatus = provider.Push(job, a)
+		sm.Metrics.ObservePush(job, pushStatus, time.Since(start))
+		if i == len(auths)-1 || !pushStatus.AuthRejected() {
+			break
+		}
+		log.Printf("Credential %d of %s for %s rejected, trying the previous one", i, job.AppName, job.Provider)
+		for _, err := range pushStatus.Errors {
+			sm.feedback(&FeedbackEvent{Type: AuthRejected, AppName: job.AppName, Provider: job.Provider,
+				Reason: err.Error(), JobID: job.Guid})
+			break
+		}
+	}
+	running := atomic.AddInt64(&sm.Stats.Running, -1)
+	// Only an override is resent, registered credentials are looked up
+	// again so they are never written to the Queue.
+	pushStatus.Auth = auth
 	job.Status = pushStatus
+	job.Attempts = append(job.Attempts, pushStatus.attempt())
+	state := JobSending
+	if pushStatus.Retry || pushStatus.Retryable() {
+		state = JobRetrying
+	}
+	sm.fold(job, state)
+
+	sent, errs := sm.Stats.counters(job.Provider)
+	if sent != nil {
+		atomic.AddUint64(sent, 1)
+		atomic.AddUint64(errs, uint64(len(pushStatus.Errors)))
+	}
+
 	if pushStatus.Retry {
-		log.Printf("Retrying job %+v in %v seconds", job, pushStatus.Delay)
 		pushStatus.ReSend(job)
 		return
 	}
+	switch {
+	case pushStatus.Ok():
+		sm.finish(job, JobDone)
+	case pushStatus.Retryable():
+		// Once for every token that failed, with only those.
+		sm.Statuses.Set(job, JobRetrying)
+		err := pushStatus.NewJob(job, pushStatus.retryTokens(job))
+		if err != nil {
+			log.Printf("Resending %s: %s", job.Guid, err)
+			sm.finish(job, JobFailed)
+		}
+	default:
+		sm.finish(job, JobFailed)
+	}
 
 	if len(pushStatus.Errors) > 0 {
-		log.Printf("(%d) Push Errors Notification: %+v PushStatus: %+v", sm.Stats.Running, job, pushStatus)
-		for _, _ = range pushStatus.Errors {
-			switch job.Provider {
-			case "apns":
-				sm.Stats.APNSErrors++
-			case "gcm":
-				sm.Stats.GCMErrors++
-			case "c2dm":
-				sm.Stats.C2DMErrors++
-			}
-		}
+		log.Printf("(%d) Push Errors Notification: %+v PushStatus: %+v", running, job, pushStatus)
 		go pushStatus.ProcessErrors(job)
-		return
 	}
 
 	if pushStatus.Ok() {
-		log.Printf("(%d) Push OK Notification: %+v", sm.Stats.Running, job)
+		log.Printf("(%d) Push OK Notification: %+v", running, job)
 	}
 
 	if len(pushStatus.Updates) > 0 {
@@ -87,33 +451,137 @@ func (sm *ServiceManager) Work(job *Notification, auth string) {
 	}
 }
 
+// ShutdownReport is what was left unfinished by Shutdown.
+type ShutdownReport struct {
+	// Guids of jobs accepted but not finished, either still waiting
+	// for a worker, waiting to be retried or interrupted mid send.
+	Pending []string
+	// Workers still sending when the deadline passed.
+	Interrupted int
+	// Whether the Pending jobs are kept by the Queue for the next
+	// start or dropped because it only lives in memory.
+	Persisted bool
+}
+
+// closer is implemented by services holding connections.
+type closer interface {
+	Close() error
+}
+
+// Shutdown stops accepting jobs and lets the workers finish what
+// they were given until ctx is done. Retries waiting for their delay
+// and jobs waiting for their send time are not waited on. Whatever
+// is not finished, including those, is left in the Queue and listed
+// in the report before the Queue is closed.
+func (sm *ServiceManager) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	sm.mu.Lock()
+	if sm.Quitting {
+		sm.mu.Unlock()
+		return nil, ErrShuttingDown
+	}
+	sm.Quitting = true
+	close(sm.Quit)
+	pools := make([]*workerPool, 0, len(sm.pools))
+	for _, pool := range sm.pools {
+		pools = append(pools, pool)
+	}
+	sm.mu.Unlock()
+
+	// Drain the workers.
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for drained := false; !drained && err == nil; {
+		drained = true
+		for _, pool := range pools {
+			drained = drained && pool.idle()
+		}
+		if drained {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	report := &ShutdownReport{}
+	for _, pool := range pools {
+		pool.close()
+		report.Interrupted += pool.Busy()
+	}
+
+	for name, service := range sm.Services {
+		if c, ok := service.(closer); ok {
+			cerr := c.Close()
+			if cerr != nil {
+				log.Printf("Closing %s: %s", name, cerr)
+			}
+		}
+	}
+
+	pending, perr := sm.Queue.Pending()
+	if perr != nil {
+		log.Printf("Shutdown: %s", perr)
+	}
+	for _, qj := range pending {
+		report.Pending = append(report.Pending, qj.Job.Guid)
+	}
+	_, inMemory := sm.Queue.(*MemoryQueue)
+	report.Persisted = !inMemory
+	sm.Queue.Close()
+	sm.DeadLetters.Close()
+
+	return report, err
+}
+
 // Close stops all workers and waits for any processing
 // work to finish before returning.
 func (sm *ServiceManager) Close() {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Recovered in Close")
-		}
-	}()
-	sm.Quitting = true
-	close(sm.Quit)
+	report, err := sm.Shutdown(context.Background())
+	if err != nil {
+		log.Printf("Close: %s", err)
+		return
+	}
+	log.Printf("Close: %d jobs pending", len(report.Pending))
 }
 
 // NewServiceManager loads a datastore and configuration files.
 func NewServiceManager() (*ServiceManager, error) {
 	services := make(map[string]Service)
-	services["apns"] = APNS{map[string]*APNSConnPool{}, &sync.Mutex{}}
-	services["gcm"] = GCM{&http.Client{}}
+	services["apns"] = APNS{Pool: map[string]*APNSConnPool{}, mu: &sync.Mutex{}}
+	services["apns2"] = APNS2{
+		Clients: map[string]*http.Client{},
+		Tokens:  map[string]*APNSToken{},
+		mu:      &sync.Mutex{},
+	}
+	services["gcm"] = GCM{Client: &http.Client{}}
 	services["c2dm"] = C2DM{&http.Client{}}
+	services["fcm"] = FCM{
+		Client: &http.Client{Timeout: 30 * time.Second},
+		Tokens: map[string]*FCMAccessToken{},
+		mu:     &sync.Mutex{},
+	}
 
 	quit := make(chan struct{})
 
 	sm := &ServiceManager{
-		Services: services,
-		Quit:     quit,
-		Quitting: false,
-		Stats:    &Stats{},
+		Services:    services,
+		Quit:        quit,
+		Quitting:    false,
+		Stats:       &Stats{},
+		Metrics:     NewMetrics(),
+		Registry:    NewRegistry(),
+		Queue:       NewMemoryQueue(),
+		Statuses:    NewStatusStore(),
+		DeadLetters: NewDeadLetters(),
+		Callbacks:   NewCallbacks(quit),
+		PoolConfigs: map[string]PoolConfig{},
+		pools:       map[string]*workerPool{},
 	}
+	sm.Retries = NewScheduler(sm.offer, quit)
+	sm.Scheduled = NewScheduler(sm.release, quit)
 	SMGlobal = sm
 	return sm, nil
 }
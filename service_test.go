@@ -1,7 +1,9 @@
 package manbearpig
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
 func TestNewServiceManager(t *testing.T) {
@@ -10,3 +12,140 @@ func TestNewServiceManager(t *testing.T) {
 		t.Fatal("Couldn't create service manager", err)
 	}
 }
+
+type testService struct {
+	pushed chan *Notification
+}
+
+func (s testService) Push(n *Notification, auth string) *PushStatus {
+	s.pushed <- n
+	return NewPushStatus(n)
+}
+
+func TestServiceManagerRecover(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	pushed := make(chan *Notification, 1)
+	sm.Services["test"] = testService{pushed}
+
+	job := &Notification{Provider: "test", DeviceTokens: []string{"a"}}
+	job.Init()
+	sm.Queue.Put(&QueuedJob{job, "abcd"})
+
+	n, err := sm.Recover()
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 job replayed got %d %v", n, err)
+	}
+	if replayed := <-pushed; replayed.Guid != job.Guid {
+		t.Fatalf("Wrong job replayed %+v", replayed)
+	}
+}
+
+func TestServiceManagerEnqueueQueueFull(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	// A single worker stuck on the first job and room for one more.
+	pushed := make(chan *Notification)
+	sm.Services["test"] = testService{pushed}
+	sm.PoolConfigs["test"] = PoolConfig{Workers: 1, QueueSize: 1}
+
+	newJob := func() *Notification {
+		return &Notification{Provider: "test", DeviceTokens: []string{"a"}}
+	}
+	err = sm.Enqueue([]*Notification{newJob()}, "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-pushed
+	err = sm.Enqueue([]*Notification{newJob()}, "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := []*Notification{newJob(), newJob()}
+	err = sm.Enqueue(rejected, "abcd")
+	if err != ErrQueueFull {
+		t.Fatalf("Expected ErrQueueFull got %v", err)
+	}
+	pending, _ := sm.Queue.Pending()
+	for _, qj := range pending {
+		if qj.Job == rejected[0] || qj.Job == rejected[1] {
+			t.Fatalf("Rejected job should not be queued %+v", qj.Job)
+		}
+	}
+
+	if second := <-pushed; second == first {
+		t.Fatal("Expected the queued job to be sent next")
+	}
+}
+
+type slowService struct {
+	delay time.Duration
+}
+
+func (s slowService) Push(n *Notification, auth string) *PushStatus {
+	time.Sleep(s.delay)
+	return NewPushStatus(n)
+}
+
+func TestServiceManagerShutdown(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.Services["test"] = slowService{20 * time.Millisecond}
+	sm.PoolConfigs["test"] = PoolConfig{Workers: 1, QueueSize: 10}
+
+	jobs := []*Notification{}
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, &Notification{Provider: "test", DeviceTokens: []string{"a"}})
+	}
+	err = sm.Enqueue(jobs, "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, err := sm.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Pending) != 0 || report.Interrupted != 0 || report.Persisted {
+		t.Fatalf("Expected every job to be drained %+v", report)
+	}
+
+	err = sm.Enqueue([]*Notification{{Provider: "test"}}, "abcd")
+	if err != ErrShuttingDown {
+		t.Fatalf("Expected ErrShuttingDown got %v", err)
+	}
+}
+
+func TestServiceManagerShutdownDeadline(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	sm.Services["test"] = slowService{time.Second}
+	sm.PoolConfigs["test"] = PoolConfig{Workers: 1, QueueSize: 10}
+
+	jobs := []*Notification{
+		{Provider: "test", DeviceTokens: []string{"a"}},
+		{Provider: "test", DeviceTokens: []string{"b"}},
+	}
+	sm.Enqueue(jobs, "abcd")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := sm.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded got %v", err)
+	}
+	if len(report.Pending) != 2 || report.Interrupted != 1 {
+		t.Fatalf("Expected both jobs unfinished %+v", report)
+	}
+}
@@ -0,0 +1,108 @@
+package manbearpig
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Job states reported by the api.
+const (
+	JobScheduled = "scheduled" // waiting for its send time
+	JobQueued    = "queued"    // accepted, waiting for a worker
+	JobSending   = "sending"   // being pushed to the provider
+	JobRetrying  = "retrying"  // waiting to be sent again
+	JobDone      = "done"      // sent to every device token
+	JobFailed    = "failed"    // finished with errors or gave up
+	JobCanceled  = "canceled"  // canceled before its send time
+)
+
+const (
+	// DefaultStatusTTL is how long finished jobs can be looked up.
+	DefaultStatusTTL time.Duration = time.Hour
+)
+
+// JobStatus is the state of a job as reported by GET /jobs/{id}.
+type JobStatus struct {
+	ID        string          `json:"id"`
+	AppName   string          `json:"app_name"`
+	Provider  string          `json:"provider"`
+	State     string          `json:"state"`
+	Retries   int             `json:"retries"`
+	Status    json.RawMessage `json:"status,omitempty"` // PushStatus.String of the last attempt
+	Reason    string          `json:"reason,omitempty"` // why a failed job was abandoned
+	ParentID  string          `json:"parent_id,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// Finished reports whether the job reached a terminal state.
+func (s *JobStatus) Finished() bool {
+	return s.State == JobDone || s.State == JobFailed || s.State == JobCanceled
+}
+
+// StatusStore keeps track of the state of recent jobs in memory.
+type StatusStore struct {
+	TTL       time.Duration // finished jobs are forgotten after this long
+	jobs      map[string]*JobStatus
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// NewStatusStore [...]
+func NewStatusStore() *StatusStore {
+	return &StatusStore{
+		TTL:       DefaultStatusTTL,
+		jobs:      map[string]*JobStatus{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Set records the state of a job along with the result of its
+// last attempt, if any.
+func (s *StatusStore) Set(job *Notification, state string) {
+	now := time.Now().UTC()
+	js := &JobStatus{
+		ID:        job.Guid,
+		AppName:   job.AppName,
+		Provider:  job.Provider,
+		State:     state,
+		Retries:   job.Retries,
+		Reason:    job.AbandonReason,
+		ParentID:  job.ParentID,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: now,
+	}
+	if job.Status != nil {
+		js.Status = json.RawMessage(job.Status.String())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.Guid] = js
+	if now.Sub(s.lastSweep) > s.TTL/10 {
+		s.sweep(now)
+	}
+}
+
+// Get returns a copy of the state of a job.
+func (s *StatusStore) Get(id string) (*JobStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	js, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	cp := *js
+	return &cp, true
+}
+
+// sweep forgets jobs that finished more than TTL ago.
+func (s *StatusStore) sweep(now time.Time) {
+	for id, js := range s.jobs {
+		if js.Finished() && now.Sub(js.UpdatedAt) > s.TTL {
+			delete(s.jobs, id)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,34 @@
+package manbearpig
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStatusStore(t *testing.T) {
+	s := NewStatusStore()
+	job := &Notification{AppName: "test", Provider: "gcm"}
+	job.Init()
+
+	s.Set(job, JobSending)
+	js, ok := s.Get(job.Guid)
+	if !ok || js.State != JobSending || js.AppName != "test" {
+		t.Fatalf("%+v", js)
+	}
+
+	job.Status = NewPushStatus(job)
+	job.Status.Errors["a"] = fmt.Errorf("NotRegistered")
+	job.Retries = 2
+	s.Set(job, JobFailed)
+	js, _ = s.Get(job.Guid)
+	if js.Retries != 2 || string(js.Status) != `{"errors":{"a":"NotRegistered"}}` {
+		t.Fatalf("%+v %s", js, js.Status)
+	}
+
+	s.sweep(time.Now().Add(2 * s.TTL))
+	_, ok = s.Get(job.Guid)
+	if ok {
+		t.Fatal("Finished job should be forgotten after the TTL")
+	}
+}
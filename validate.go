@@ -0,0 +1,109 @@
+package manbearpig
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// MaxTTL is the longest expiry gcm and fcm accept, 4 weeks.
+const MaxTTL uint32 = 2419200
+
+// ValidationError is a problem with one field of a job that keeps
+// it from being accepted.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Code)
+}
+
+// JobErrors are the validation errors of the job at Index in a request.
+type JobErrors struct {
+	Index  int                `json:"index"`
+	Errors []*ValidationError `json:"errors"`
+}
+
+// Validator is implemented by services with rules of their own,
+// checked once the rules common to every provider passed.
+type Validator interface {
+	Validate(*Notification) []*ValidationError
+}
+
+// Validate checks a job before it is accepted.
+func (sm *ServiceManager) Validate(job *Notification) []*ValidationError {
+	var errs []*ValidationError
+	service, ok := sm.Services[job.Provider]
+	if !ok {
+		errs = append(errs, &ValidationError{"provider", "UnknownProvider", fmt.Sprintf("unknown provider %q", job.Provider)})
+	}
+	if len(job.DeviceTokens) == 0 {
+		errs = append(errs, &ValidationError{"device_tokens", "MissingDeviceTokens", ""})
+	}
+	for i, token := range job.DeviceTokens {
+		if token == "" {
+			errs = append(errs, &ValidationError{fmt.Sprintf("device_tokens[%d]", i), "InvalidDeviceToken", "empty token"})
+		}
+	}
+	if len(job.Payload) == 0 {
+		errs = append(errs, &ValidationError{"payload", "MissingPayload", ""})
+	}
+	errs = append(errs, validateSchedule(job)...)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if v, ok := service.(Validator); ok {
+		errs = v.Validate(job)
+	}
+	return errs
+}
+
+// validateHexTokens checks device tokens are hex of size bytes, any
+// size if 0.
+func validateHexTokens(job *Notification, size int) []*ValidationError {
+	var errs []*ValidationError
+	for i, token := range job.DeviceTokens {
+		b, err := hex.DecodeString(token)
+		if err != nil || (size > 0 && len(b) != size) {
+			errs = append(errs, &ValidationError{fmt.Sprintf("device_tokens[%d]", i), "InvalidDeviceToken", "not a hex encoded apns token"})
+		}
+	}
+	return errs
+}
+
+// validatePayloadSize checks the encoded payload is at most max bytes.
+func validatePayloadSize(size, max int) []*ValidationError {
+	if size > max {
+		return []*ValidationError{{"payload", "MessageTooBig", fmt.Sprintf("payload is %d bytes, max %d", size, max)}}
+	}
+	return nil
+}
+
+// validateTTL checks the expiry is at most MaxTTL.
+func validateTTL(job *Notification) []*ValidationError {
+	if job.Expiry > MaxTTL {
+		return []*ValidationError{{"expiry", "InvalidTTL", fmt.Sprintf("expiry is over %d seconds", MaxTTL)}}
+	}
+	return nil
+}
+
+// validateEnvironment checks an apns environment is known.
+func validateEnvironment(job *Notification) []*ValidationError {
+	if _, ok := apnsUrls[job.Environment]; job.Environment != "" && !ok {
+		return []*ValidationError{{"environment", "InvalidEnvironment", "environment must be sandbox or production"}}
+	}
+	return nil
+}
+
+// validatePriority checks an apns priority is 5 or 10, or 0 for the
+// default.
+func validatePriority(job *Notification) []*ValidationError {
+	switch job.Priority {
+	case 0, 5, 10:
+		return nil
+	}
+	return []*ValidationError{{"priority", "InvalidPriority", "priority must be 5 or 10"}}
+}
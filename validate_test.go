@@ -0,0 +1,49 @@
+package manbearpig
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	sm, err := NewServiceManager()
+	if err != nil {
+		t.Fatal("Couldn't create service manager", err)
+	}
+	token := strings.Repeat("ab", 32)
+	big := strings.Repeat("x", 4097)
+
+	tests := []struct {
+		job  *Notification
+		code string
+	}{
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"payload": `{"aps":{}}`}}, ""},
+		{&Notification{Provider: "apns", DeviceTokens: []string{"abcd"}, Payload: map[string]interface{}{"payload": `{}`}}, "InvalidDeviceToken"},
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"payload": big[:2049]}}, "MessageTooBig"},
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"payload": `{}`}, Priority: 7}, "InvalidPriority"},
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{"alert": map[string]interface{}{"title": "hi"}, "badge": 3.0, "sound": "default", "content-available": 1}, "x": []int{1}}}, ""},
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": "hi"}}, "InvalidAPS"},
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{"badge": "3"}}}, "InvalidAPS"},
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{"alert": 1}}}, "InvalidAPS"},
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{"mutable-content": 2}}}, "InvalidAPS"},
+		{&Notification{Provider: "apns", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{"alert": big[:2049]}}}, "MessageTooBig"},
+		{&Notification{Provider: "apns2", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{}}, CollapseKey: big[:65]}, "InvalidCollapseKey"},
+		{&Notification{Provider: "apns2", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{"alert": big[:3000]}}}, ""},
+		{&Notification{Provider: "apns2", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{"category": 1}}}, "InvalidAPS"},
+		{&Notification{Provider: "apns2", DeviceTokens: []string{token}, Payload: map[string]interface{}{"aps": map[string]interface{}{"alert": big}}}, "MessageTooBig"},
+		{&Notification{Provider: "gcm", DeviceTokens: []string{"a"}, Payload: map[string]interface{}{"a": big}}, "MessageTooBig"},
+		{&Notification{Provider: "gcm", DeviceTokens: []string{"a"}, Payload: map[string]interface{}{"a": 1}, Expiry: MaxTTL + 1}, "InvalidTTL"},
+		{&Notification{Provider: "fcm", DeviceTokens: []string{""}, Payload: map[string]interface{}{"a": 1}}, "InvalidDeviceToken"},
+		{&Notification{Provider: "c2dm", DeviceTokens: []string{"a"}, Payload: map[string]interface{}{"a": big[:1024]}}, "MessageTooBig"},
+		{&Notification{Provider: "gcm", DeviceTokens: []string{"a"}}, "MissingPayload"},
+	}
+	for i, test := range tests {
+		errs := sm.Validate(test.job)
+		switch {
+		case test.code == "" && len(errs) > 0:
+			t.Errorf("%d: Expected no errors got %v", i, errs)
+		case test.code != "" && (len(errs) == 0 || errs[0].Code != test.code):
+			t.Errorf("%d: Expected %s got %v", i, test.code, errs)
+		}
+	}
+}